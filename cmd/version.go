@@ -1,10 +1,21 @@
 package cmd
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
 	"github.inodinwetrust10/godex/pkg/version"
 )
@@ -19,33 +30,98 @@ var (
 )
 
 var createCmd = &cobra.Command{
-	Use:   "create [filepath]",
-	Short: "Create a new version of a file",
-	Args:  cobra.ExactArgs(1),
-	RunE:  createVersion,
+	Use:   "create [path]",
+	Short: "Create a new version of a file or a snapshot of a directory",
+	Long: `Create a new version of a file or a snapshot of a directory. When the path has no
+versions yet but holds exactly the latest version, or the restored one, of a tracked
+file that no longer exists, godex asks whether it was moved and, if so, continues that history here.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         createVersion,
 }
 
-var listCmd = &cobra.Command{
-	Use:   "list [filepath]",
-	Short: "List all versions of a file",
-	Args:  cobra.ExactArgs(1),
-	RunE:  listVersion,
+var moveCmd = &cobra.Command{
+	Use:   "mv [oldpath] [newpath]",
+	Short: "Move a file and its history to a new path",
+	Long: `Move the versions, tags and retention policy of oldpath to newpath. When oldpath
+still exists it is moved as well; when it was already moved only the history follows.`,
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         moveVersions,
 }
 
-var restoreCmd = &cobra.Command{
-	Use:   "restore [filepath] [versionID]",
-	Short: "Restore your file to a specific versionID",
-	Args:  cobra.ExactArgs(2),
-	RunE:  restoreVersion,
-}
+var (
+	listGraph bool
+	listSince string
+	listCmd   = &cobra.Command{
+		Use:   "list [filepath]",
+		Short: "List all versions of a file",
+		Long: `List all versions of a file, or with --since only those created since a time like
+"2026-10-01 14:00", yesterday or an age like 3h.`,
+		Args: cobra.ExactArgs(1),
+		RunE: listVersion,
+	}
+)
+
+var (
+	restoreSubPath    string
+	restoreClean      bool
+	restoreOutput     string
+	restoreStdout     bool
+	restoreNoSnapshot bool
+	restoreAt         string
+	restoreAgo        string
+	restoreCmd        = &cobra.Command{
+		Use:   "restore [filepath] [versionID|tag]",
+		Short: "Restore your file or directory to a specific versionID or tag",
+		Long: `Restore a file or directory to a version. When the working copy was changed since
+the version it is based on, it is saved as a new version first, so nothing is lost;
+--no-snapshot skips that. With --output the version is written to another path and
+with --stdout to standard output, leaving the working copy alone. Instead of a version,
+--at "2026-10-01 14:00" or --ago 3h restores the version the file had at that time.`,
+		Args:         cobra.RangeArgs(1, 2),
+		SilenceUsage: true,
+		RunE:         restoreVersion,
+	}
+)
+
+var (
+	showPath string
+	showAt   string
+	showAgo  string
+	showCmd  = &cobra.Command{
+		Use:   "show [filepath] [versionID|tag]",
+		Short: "Print the content of a version",
+		Long: `Write the content of a version to standard output. For a directory snapshot the
+entries are listed, or the content of one of its files is written with --path. Instead
+of a version, --at or --ago shows the version the file had at that time.`,
+		Args:         cobra.RangeArgs(1, 2),
+		SilenceUsage: true,
+		RunE:         showVersion,
+	}
+)
 
 var (
 	useLastVersion bool
+	diffFrom       string
+	diffTo         string
+	diffSince      string
+	diffAt         string
+	diffAgo        string
+	diffContext    int
+	diffFormat     string
+	diffWordDiff   bool
+	diffColor      string
+	diffHex        bool
+	diffSemantic   bool
 	seeDiffCmd     = &cobra.Command{
 		Use:   "diff [filepath1] [filepath2]",
 		Short: "Check diffs between two files",
-		Args:  cobra.MinimumNArgs(1),
-		RunE:  seeDiff,
+		Long: `Compare two files, or a file with one of its versions. --from picks the old side by
+version ID or tag, --at and --ago by the time the file had it, and --since compares
+everything that changed since a time, such as yesterday, with the working copy or --to.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: seeDiff,
 	}
 )
 
@@ -59,16 +135,339 @@ var (
 	}
 )
 
+var (
+	deleteTag bool
+	tagCmd    = &cobra.Command{
+		Use:   "tag [filepath] [versionID] [name]",
+		Short: "Name a version so it can be restored by that name",
+		Long: `Give a version a name like release-1.2. Without arguments after the file the tags
+are listed, with --delete the named tag is removed.`,
+		Args: cobra.RangeArgs(1, 3),
+		RunE: tagVersion,
+	}
+)
+
+var (
+	annotateMessage string
+	annotateLabels  []string
+	annotateUnlabel []string
+	annotateAt      string
+	annotateAgo     string
+	annotateCmd     = &cobra.Command{
+		Use:   "annotate [filepath] [versionID|tag]",
+		Short: "Change the message and labels of a version",
+		Long: `Change the message of a version with --message and add key=value labels, such as
+a ticket ID, with --label or remove them with --unlabel. Without flags the message,
+author, host and labels of the version are shown.`,
+		Args:         cobra.RangeArgs(1, 2),
+		SilenceUsage: true,
+		RunE:         annotateVersion,
+	}
+)
+
+var (
+	logGrep   string
+	logAuthor string
+	logSince  string
+	logLabels []string
+	logCmd    = &cobra.Command{
+		Use:   "log",
+		Short: "Search the versions of all tracked files",
+		Long: `List the versions of all tracked files, newest first. --grep matches a regular
+expression against the message and the labels, --author matches part of author@host
+ignoring case, and --label key or key=value selects versions with that label.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         searchLog,
+	}
+)
+
+var blameCmd = &cobra.Command{
+	Use:   "blame [filepath] [versionID|tag]",
+	Short: "Show which version last changed each line of a file",
+	Long: `Label every line of the working copy, or of a version, with the version that last
+changed it, when that version was created and its message. The versions the file is
+based on are followed back to the first one. Lines changed in the working copy since
+its last version are marked as not versioned yet.`,
+	Args:         cobra.RangeArgs(1, 2),
+	SilenceUsage: true,
+	RunE:         blameFile,
+}
+
+var (
+	patchOutput  string
+	patchContext int
+	patchCmd     = &cobra.Command{
+		Use:   "patch [filepath] [fromID|tag] [toID|tag]",
+		Short: "Write the change between two versions as a patch",
+		Long: `Write the change from one version of a file to another, or to the working copy when
+the second version is left out, as a unified diff. The patch can be applied with
+version apply to a copy of the file with its own history, or with patch -p1 or git apply.`,
+		Args:         cobra.RangeArgs(2, 3),
+		SilenceUsage: true,
+		RunE:         makePatch,
+	}
+)
+
+var (
+	applyFuzz       int
+	applyDryRun     bool
+	applyRejectFile string
+	applyCmd        = &cobra.Command{
+		Use:   "apply [filepath] [patch]",
+		Short: "Apply a patch to a file",
+		Long: `Apply a patch written by version patch to a file; "-" reads the patch from standard
+input. Hunks are looked for near the line they name and then further away, and with
+--fuzz up to that many context lines at each end of a hunk may differ. Hunks whose
+change is already in the file are skipped. Hunks that do not fit are written to
+<filepath>.rej and the command exits with a non-zero status; the others are applied.`,
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE:         applyPatch,
+	}
+)
+
+var (
+	prunePolicy      version.RetentionPolicy
+	pruneDryRun      bool
+	pruneSave        bool
+	pruneClearPolicy bool
+	pruneCmd         = &cobra.Command{
+		Use:   "prune [filepath]",
+		Short: "Remove old versions of a file according to a retention policy",
+		Long: `Remove the versions a retention policy does not keep. The keep rules can be combined:
+a version is kept when any of them selects it. --max-age and --max-size then remove the
+oldest remaining versions, and --auto-keep-last and --auto-max-age do the same for
+versions created by godex watch only. The version the file is based on and tagged
+versions are always kept. Without policy flags the policy saved for the file is used; --save stores
+the given flags as that policy, which version create applies after every new version.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         pruneVersions,
+	}
+)
+
+var (
+	repackMaxChain int
+	repackCmd      = &cobra.Command{
+		Use:   "repack",
+		Short: "Rebuild the delta chains of the version store",
+		Long: `Store every older version as a delta against its newer version, keep the newest
+version of every branch whole, and store content whole again wherever a delta chain
+is longer than --max-chain.`,
+		Args: cobra.NoArgs,
+		RunE: repackVersions,
+	}
+)
+
+var (
+	encryptKeyFile string
+	encryptCmd     = &cobra.Command{
+		Use:   "encrypt",
+		Short: "Encrypt the version store with a passphrase or a key file",
+		Long: `Turn on encryption for the version store and encrypt everything already in it.
+Without --key-file a passphrase is asked for, or read from GODEX_NEW_PASSPHRASE.
+Later commands read the passphrase from GODEX_PASSPHRASE or ask for it, and the
+key file from GODEX_KEY_FILE.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         encryptStore,
+	}
+	rekeyCmd = &cobra.Command{
+		Use:   "rekey",
+		Short: "Re-encrypt the version store with a new key",
+		Long: `Encrypt the version store with a fresh data key protected by a new passphrase or
+key file. The current passphrase or key file is needed to read the store first.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         rekeyStore,
+	}
+)
+
+var (
+	statusJSON bool
+	statusCmd  = &cobra.Command{
+		Use:   "status",
+		Short: "Show which tracked files changed since their last version",
+		Long: `Compare every file and directory that has versions with the version it is based on
+and report it as unchanged, modified, or missing when it was deleted or moved. The
+number of versions, their total size and the space they take in the store are shown
+too; content shared with other files counts for each of them.`,
+		Args: cobra.NoArgs,
+		RunE: versionStatus,
+	}
+)
+
+var (
+	exportOutput string
+	exportCmd    = &cobra.Command{
+		Use:   "export [filepath]",
+		Short: "Write the whole history of a file to a portable bundle",
+		Long: `Write every version of a file with its metadata, tags and content to a single
+bundle file that version import can read on another machine. Without --output the
+bundle is written to <name>.gdxb in the current directory; "-" writes it to
+standard output.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         exportHistory,
+	}
+)
+
+var (
+	importAs  string
+	importCmd = &cobra.Command{
+		Use:   "import [bundle]",
+		Short: "Import the history of a file from a bundle",
+		Long: `Read a bundle written by version export and make it the history of the file it was
+exported from, or of --as. The file must not have versions yet. All content is
+checked against its checksum; "-" reads the bundle from standard input.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         importHistory,
+	}
+)
+
+var (
+	fsckRepair bool
+	fsckCmd    = &cobra.Command{
+		Use:   "fsck",
+		Short: "Check the version store for corrupt or inconsistent data",
+		Long: `Read back every chunk, manifest and version and check them against their SHA-256
+checksums, and look for tags, HEAD files, reference counts and version directories
+that do not match the index. With --repair, versions that cannot be read back are
+removed, full copies missing from the index are recovered as versions, dangling tags
+are dropped and the reference counts are rebuilt from what is on disk.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         checkStore,
+	}
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config [key] [value]",
+	Short: "Show or change settings of the version store",
+	Long: `Show all settings, show one key or set a key. Available keys:
+  compression   codec for newly stored content: zstd (default), gzip or none`,
+	Args: cobra.MaximumNArgs(2),
+	RunE: versionConfig,
+}
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge [filepath] [versionID|tag]",
+	Short: "Three-way merge a version into the working file",
+	Long: `Merge a version into the working file using the common ancestor of that version and
+the version the working file is based on. Conflicting changes are written with
+conflict markers and the command exits with a non-zero status.`,
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         mergeVersion,
+}
+
 func init() {
 	createCmd.Flags().StringVarP(&message, "message", "m", "commit", "Add a commit message")
 	seeDiffCmd.Flags().
 		BoolVarP(&useLastVersion, "default", "d", false, "Compare with the last version")
+	seeDiffCmd.Flags().StringVar(&diffFrom, "from", "", "Compare starting from this versionID")
+	seeDiffCmd.Flags().
+		StringVar(&diffTo, "to", "", "Compare up to this versionID (default is the working copy)")
+	seeDiffCmd.Flags().StringVar(&diffAt, "at", "", "Compare starting from the version the file had at this time")
+	seeDiffCmd.Flags().StringVar(&diffAgo, "ago", "", "Compare starting from the version the file had this long ago, e.g. 3h")
+	seeDiffCmd.Flags().StringVar(&diffSince, "since", "", "Compare everything that changed since this time")
+	seeDiffCmd.MarkFlagsMutuallyExclusive("from", "at", "ago", "since")
+	seeDiffCmd.Flags().
+		IntVarP(&diffContext, "unified", "U", 3, "Number of context lines around each change")
+	seeDiffCmd.Flags().
+		StringVar(&diffFormat, "format", version.FormatUnified, "Output format: unified or side-by-side")
+	seeDiffCmd.Flags().BoolVar(&diffHex, "hex", false, "Show a hex dump of the changed bytes of binary files")
+	seeDiffCmd.Flags().
+		BoolVar(&diffSemantic, "semantic", false, "Compare JSON, YAML or TOML files by key path")
+	seeDiffCmd.Flags().BoolVar(&diffWordDiff, "word-diff", false, "Show changed words inside a line")
+	seeDiffCmd.Flags().
+		StringVar(&diffColor, "color", "auto", "Colorize the output: auto, always or never")
+	restoreCmd.Flags().
+		StringVarP(&restoreSubPath, "path", "p", "", "Restore only this path of a directory snapshot")
+	restoreCmd.Flags().
+		BoolVar(&restoreClean, "delete", false, "Remove files that are not part of the directory snapshot")
+	restoreCmd.Flags().StringVarP(&restoreOutput, "output", "o", "", "Write the version to this path instead")
+	restoreCmd.Flags().BoolVar(&restoreStdout, "stdout", false, "Write the version to standard output")
+	restoreCmd.Flags().
+		BoolVar(&restoreNoSnapshot, "no-snapshot", false, "Do not save a changed working copy before restoring")
+	restoreCmd.Flags().StringVar(&restoreAt, "at", "", "Restore the version the file had at this time")
+	restoreCmd.Flags().StringVar(&restoreAgo, "ago", "", "Restore the version the file had this long ago, e.g. 3h")
+	restoreCmd.MarkFlagsMutuallyExclusive("output", "stdout")
+	restoreCmd.MarkFlagsMutuallyExclusive("at", "ago")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Write the bundle to this file")
+	importCmd.Flags().StringVar(&importAs, "as", "", "Import the history for this path instead")
+	fsckCmd.Flags().BoolVar(&fsckRepair, "repair", false, "Fix the problems that were found")
+	showCmd.Flags().StringVarP(&showPath, "path", "p", "", "Show this file of a directory snapshot")
+	showCmd.Flags().StringVar(&showAt, "at", "", "Show the version the file had at this time")
+	showCmd.Flags().StringVar(&showAgo, "ago", "", "Show the version the file had this long ago, e.g. 3h")
+	showCmd.MarkFlagsMutuallyExclusive("at", "ago")
+	annotateCmd.Flags().StringVarP(&annotateMessage, "message", "m", "", "Replace the message of the version")
+	annotateCmd.Flags().StringArrayVar(&annotateLabels, "label", nil, "Add a key=value label, can be repeated")
+	annotateCmd.Flags().StringArrayVar(&annotateUnlabel, "unlabel", nil, "Remove the label with this key, can be repeated")
+	annotateCmd.Flags().StringVar(&annotateAt, "at", "", "Annotate the version the file had at this time")
+	annotateCmd.Flags().StringVar(&annotateAgo, "ago", "", "Annotate the version the file had this long ago, e.g. 3h")
+	annotateCmd.MarkFlagsMutuallyExclusive("at", "ago")
+	logCmd.Flags().StringVar(&logGrep, "grep", "", "Only versions whose message or labels match this regular expression")
+	logCmd.Flags().StringVar(&logAuthor, "author", "", "Only versions created by this author or on this host")
+	logCmd.Flags().StringVar(&logSince, "since", "", "Only versions created since this time")
+	logCmd.Flags().StringArrayVar(&logLabels, "label", nil, "Only versions with this label key or key=value")
+	patchCmd.Flags().StringVarP(&patchOutput, "output", "o", "", "Write the patch to this file instead of standard output")
+	patchCmd.Flags().IntVarP(&patchContext, "unified", "U", 3, "Number of context lines around each change")
+	applyCmd.Flags().IntVar(&applyFuzz, "fuzz", 2, "Context lines at each end of a hunk that may differ")
+	applyCmd.Flags().BoolVarP(&applyDryRun, "dry-run", "n", false, "Only show whether the patch applies")
+	applyCmd.Flags().StringVar(&applyRejectFile, "reject-file", "", "Write rejected hunks to this file (default <filepath>.rej)")
+	listCmd.Flags().BoolVar(&listGraph, "graph", false, "Draw the branches of the history as a graph")
+	listCmd.Flags().StringVar(&listSince, "since", "", "Only list versions created since this time")
+	listCmd.MarkFlagsMutuallyExclusive("graph", "since")
+	tagCmd.Flags().BoolVarP(&deleteTag, "delete", "d", false, "Delete the named tag")
+	pruneCmd.Flags().IntVar(&prunePolicy.KeepLast, "keep-last", 0, "Keep the last N versions")
+	pruneCmd.Flags().IntVar(&prunePolicy.KeepDaily, "keep-daily", 0, "Keep the newest version of each of the last N days")
+	pruneCmd.Flags().
+		IntVar(&prunePolicy.KeepWeekly, "keep-weekly", 0, "Keep the newest version of each of the last N weeks")
+	pruneCmd.Flags().
+		IntVar(&prunePolicy.KeepMonthly, "keep-monthly", 0, "Keep the newest version of each of the last N months")
+	pruneCmd.Flags().
+		Int64Var(&prunePolicy.MaxBytes, "max-size", 0, "Maximum total size in bytes of the kept versions")
+	pruneCmd.Flags().StringVar(&prunePolicy.MaxAge, "max-age", "", "Remove versions older than this, e.g. 30d, 2w or 12h")
+	pruneCmd.Flags().
+		IntVar(&prunePolicy.AutoKeepLast, "auto-keep-last", 0, "Keep at most the last N versions created by godex watch")
+	pruneCmd.Flags().
+		StringVar(&prunePolicy.AutoMaxAge, "auto-max-age", "", "Remove versions created by godex watch older than this")
+	pruneCmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "n", false, "Only show what would be removed")
+	pruneCmd.Flags().BoolVar(&pruneSave, "save", false, "Save the policy for this file and apply it on every create")
+	pruneCmd.Flags().BoolVar(&pruneClearPolicy, "clear-policy", false, "Remove the policy saved for this file")
+	repackCmd.Flags().
+		IntVar(&repackMaxChain, "max-chain", version.DefaultMaxChain, "Longest delta chain to keep")
+	encryptCmd.Flags().StringVar(&encryptKeyFile, "key-file", "", "Derive the key from this file instead of a passphrase")
+	rekeyCmd.Flags().StringVar(&encryptKeyFile, "key-file", "", "Derive the new key from this file instead of a passphrase")
+	version.PassphraseFunc = readPassphrase
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON")
 	removeCmd.Flags().StringVarP(&versionToRemove, "version", "v", "", "Remove a specific version")
 	versionCmd.AddCommand(removeCmd)
 	versionCmd.AddCommand(createCmd)
 	versionCmd.AddCommand(listCmd)
 	versionCmd.AddCommand(restoreCmd)
 	versionCmd.AddCommand(seeDiffCmd)
+	versionCmd.AddCommand(mergeCmd)
+	versionCmd.AddCommand(tagCmd)
+	versionCmd.AddCommand(pruneCmd)
+	versionCmd.AddCommand(configCmd)
+	versionCmd.AddCommand(repackCmd)
+	versionCmd.AddCommand(encryptCmd)
+	versionCmd.AddCommand(rekeyCmd)
+	versionCmd.AddCommand(statusCmd)
+	versionCmd.AddCommand(moveCmd)
+	versionCmd.AddCommand(showCmd)
+	versionCmd.AddCommand(exportCmd)
+	versionCmd.AddCommand(importCmd)
+	versionCmd.AddCommand(fsckCmd)
+	versionCmd.AddCommand(annotateCmd)
+	versionCmd.AddCommand(logCmd)
+	versionCmd.AddCommand(blameCmd)
+	versionCmd.AddCommand(patchCmd)
+	versionCmd.AddCommand(applyCmd)
 	rootCmd.AddCommand(versionCmd)
 }
 
@@ -77,6 +476,17 @@ func createVersion(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	movedFrom, err := version.FindMovedFrom(filePath)
+	if err != nil {
+		return err
+	}
+	if movedFrom != "" && confirm(fmt.Sprintf("%s has the content of the latest version of %s, which no longer exists. Was it moved here?", filePath, movedFrom)) {
+		if err := version.MoveFile(movedFrom, filePath); err != nil {
+			return err
+		}
+		fmt.Printf("The history of %s now continues at %s\n", movedFrom, filePath)
+		return nil
+	}
 	id, err := version.GenerateVersionID(filePath)
 	if err != nil {
 		return err
@@ -100,19 +510,90 @@ func listVersion(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	if listGraph {
+		graph, err := version.FormatVersionGraph(filePath)
+		if err != nil {
+			return err
+		}
+		fmt.Print(graph)
+		return nil
+	}
 	list, err := version.ListAllVersions(filePath)
 	if err != nil {
 		return err
 	}
+	tags, err := version.VersionTags(filePath)
+	if err != nil {
+		return err
+	}
+	var since time.Time
+	if listSince != "" {
+		if since, err = version.ParseTime(listSince, time.Now()); err != nil {
+			return err
+		}
+	}
 	for _, data := range *list {
+		if data.CreatedAt.Before(since) {
+			continue
+		}
 		fmt.Printf("ID: %s\n", data.ID)
+		if data.Parent != "" {
+			fmt.Printf("Parent: %s\n", data.Parent)
+		}
+		if data.MergeParent != "" {
+			fmt.Printf("Merged: %s\n", data.MergeParent)
+		}
+		if len(tags[data.ID]) > 0 {
+			fmt.Printf("Tags: %s\n", strings.Join(tags[data.ID], ", "))
+		}
 		fmt.Printf("Message: %s\n", data.Message)
+		if data.Auto {
+			fmt.Println("Created by: godex watch")
+		}
+		if data.Author != "" || data.Host != "" {
+			fmt.Printf("Author: %s\n", formatOrigin(data))
+		}
+		if len(data.Labels) > 0 {
+			fmt.Printf("Labels: %s\n", formatLabels(data.Labels))
+		}
 		fmt.Printf("Created At: %s\n", data.CreatedAt)
 		fmt.Printf("Size(in Bytes): %d\n", data.Size)
+		if data.IsDir {
+			fmt.Printf("Files: %d\n", countSnapshotFiles(data.Tree))
+		}
 	}
 	return nil
 }
 
+// /////////////////////////////////////////////////////////////////////
+// /////////////////////////////////////////////////////////////////////
+func moveVersions(cmd *cobra.Command, args []string) error {
+	oldPath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	newPath, err := filepath.Abs(args[1])
+	if err != nil {
+		return err
+	}
+	if err := version.MoveFile(oldPath, newPath); err != nil {
+		return err
+	}
+	fmt.Printf("Moved the history of %s to %s\n", oldPath, newPath)
+	return nil
+}
+
+// confirm asks a yes/no question on the terminal. Without one the answer is no.
+func confirm(question string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 // /////////////////////////////////////////////////////////////////////
 // /////////////////////////////////////////////////////////////////////
 func restoreVersion(cmd *cobra.Command, args []string) error {
@@ -124,25 +605,152 @@ func restoreVersion(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	err = version.RestoreFile(versionDir, args[1], filePath)
+	id, err := versionArg(versionDir, args, restoreAt, restoreAgo)
+	if err != nil {
+		return err
+	}
+	meta, err := version.FindVersion(versionDir, id)
+	if err != nil {
+		return err
+	}
+	if restoreStdout {
+		return version.WriteVersion(versionDir, id, restoreSubPath, os.Stdout)
+	}
+
+	target := filePath
+	if restoreOutput != "" {
+		if target, err = filepath.Abs(restoreOutput); err != nil {
+			return err
+		}
+	} else if !restoreNoSnapshot {
+		saved, ok, err := version.SaveWorkingCopy(filePath, "before restoring "+id)
+		if err != nil {
+			return fmt.Errorf("failed to save the working copy before restoring: %w", err)
+		}
+		if ok {
+			fmt.Printf("Saved the working copy as version %s\n", saved.ID)
+		}
+	}
+
+	if meta.IsDir {
+		err = version.RestoreTree(versionDir, id, target, restoreSubPath, restoreClean)
+		if err != nil {
+			return err
+		}
+		if restoreOutput != "" {
+			fmt.Printf("Version %s written to %s\n", id, target)
+			return nil
+		}
+		fmt.Printf("Directory restored to version %s successfully\n", id)
+		return nil
+	}
+	if restoreSubPath != "" {
+		return fmt.Errorf("--path can only be used with directory snapshots")
+	}
+	err = version.RestoreFile(versionDir, id, target)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("File restored to version %s successfully", args[1])
+	if restoreOutput != "" {
+		fmt.Printf("Version %s written to %s\n", id, target)
+		return nil
+	}
+	fmt.Printf("File restored to version %s successfully", id)
 	return nil
 }
 
+// /////////////////////////////////////////////////////////////////////
+// /////////////////////////////////////////////////////////////////////
+func showVersion(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	versionDir, err := version.GetVersionPath(filePath)
+	if err != nil {
+		return err
+	}
+	id, err := versionArg(versionDir, args, showAt, showAgo)
+	if err != nil {
+		return err
+	}
+	meta, err := version.FindVersion(versionDir, id)
+	if err != nil {
+		return err
+	}
+	// without a file to show, a snapshot is shown as its list of entries
+	if meta.IsDir && showPath == "" {
+		for _, entry := range meta.Tree {
+			fmt.Printf("%s %10d %s\n", entry.Mode, entry.Size, entry.Path)
+		}
+		return nil
+	}
+	return version.WriteVersion(versionDir, id, showPath, os.Stdout)
+}
+
+// versionArg resolves the version given as the second argument, or by the
+// --at or --ago value of the command.
+func versionArg(versionDir string, args []string, atTime, agoAge string) (string, error) {
+	if atTime == "" && agoAge == "" {
+		if len(args) < 2 {
+			return "", fmt.Errorf("give a versionID, a tag, --at or --ago")
+		}
+		return version.ResolveVersion(versionDir, args[1])
+	}
+	if len(args) > 1 {
+		return "", fmt.Errorf("give either a version or --at/--ago, not both")
+	}
+	return versionAtFlag(versionDir, atTime, agoAge)
+}
+
+func versionAtFlag(versionDir, atTime, agoAge string) (string, error) {
+	var at time.Time
+	if agoAge != "" {
+		age, err := version.ParseAge(agoAge)
+		if err != nil {
+			return "", err
+		}
+		at = time.Now().Add(-age)
+	} else {
+		var err error
+		if at, err = version.ParseTime(atTime, time.Now()); err != nil {
+			return "", err
+		}
+	}
+	meta, err := version.VersionAt(versionDir, at)
+	return meta.ID, err
+}
+
+func countSnapshotFiles(tree []version.TreeEntry) int {
+	count := 0
+	for _, entry := range tree {
+		if entry.Mode.IsRegular() {
+			count++
+		}
+	}
+	return count
+}
+
 ////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////
 
 func seeDiff(cmd *cobra.Command, args []string) error {
 	var diffRes version.DiffResult
+	if (diffFrom != "" || diffAt != "" || diffAgo != "" || diffSince != "") && len(args) == 1 {
+		return diffVersions(args[0])
+	}
 	if useLastVersion && len(args) == 1 {
 		filePath, err := filepath.Abs(args[0])
 		if err != nil {
 			return err
 		}
 		fileDir, err := version.GetVersionPath(filePath)
+		if err != nil {
+			return err
+		}
+		if isDirectory(filePath) {
+			return diffLastSnapshot(filePath, fileDir)
+		}
 		lastVersionPath := version.ReturnLastSecondFilePath(fileDir)
 		if lastVersionPath == "No file found" {
 			return fmt.Errorf("No last version found. Make a version first to check")
@@ -150,10 +758,12 @@ func seeDiff(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("No previous version found to check")
 		}
 
-		diffRes, err = version.FileDiff(filePath, lastVersionPath)
+		diffRes, err = version.FileDiffWithOptions(lastVersionPath, filePath, diffOptions(filePath))
 		if err != nil {
 			return err
 		}
+		diffRes.OldName = diffLabel("a", args[0])
+		diffRes.NewName = diffLabel("b", args[0])
 	} else if len(args) == 2 {
 		filePath1, err := filepath.Abs(args[0])
 		if err != nil {
@@ -165,21 +775,29 @@ func seeDiff(cmd *cobra.Command, args []string) error {
 			return err
 		}
 
-		diffRes, err = version.FileDiff(filePath1, filePath2)
+		if isDirectory(filePath1) && isDirectory(filePath2) {
+			treeDiff, err := version.DiffDirectories(filePath1, filePath2)
+			if err != nil {
+				return err
+			}
+			version.PrintTreeDiff(&treeDiff)
+			return nil
+		}
+
+		diffRes, err = version.FileDiffWithOptions(filePath1, filePath2, diffOptions(filePath1))
 		if err != nil {
 			return err
 		}
+		diffRes.OldName = args[0]
+		diffRes.NewName = args[1]
 	} else {
 		return fmt.Errorf("incorrect number of arguments: provide either one file with -d flag or two files to compare")
 	}
-	version.PrintDiffResults(&diffRes)
-	return nil
+	return printDiff(&diffRes)
 }
 
-// //////////////////////////////////////////////////////////////////////////////////////////
-// //////////////////////////////////////////////////////////////////////////////////////////
-func removeVersion(cmd *cobra.Command, args []string) error {
-	filePath, err := filepath.Abs(args[0])
+func diffVersions(path string) error {
+	filePath, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
@@ -187,19 +805,770 @@ func removeVersion(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	if cmd.Flags().Changed("version") {
-		err := version.ClearVersion(fileDir, versionToRemove)
+	var fromID string
+	switch {
+	case diffFrom != "":
+		fromID, err = version.ResolveVersion(fileDir, diffFrom)
+	case diffSince != "":
+		var since time.Time
+		if since, err = version.ParseTime(diffSince, time.Now()); err == nil {
+			var meta version.VersionMetaData
+			meta, err = version.VersionSince(fileDir, since)
+			fromID = meta.ID
+		}
+	default:
+		fromID, err = versionAtFlag(fileDir, diffAt, diffAgo)
+	}
+	if err != nil {
+		return err
+	}
+	toID := ""
+	if diffTo != "" {
+		toID, err = version.ResolveVersion(fileDir, diffTo)
 		if err != nil {
 			return err
 		}
+	}
+	from, err := version.FindVersion(fileDir, fromID)
+	if err != nil {
+		return err
+	}
 
-		fmt.Printf("Version with verisonID %s is cleared", versionToRemove)
-	} else {
-		err := version.ClearAllVersion(fileDir)
+	if from.IsDir {
+		treeDiff, err := version.DiffSnapshot(fileDir, fromID, toID, filePath)
 		if err != nil {
 			return err
 		}
-		fmt.Println("All versions of this file are now cleared")
+		version.PrintTreeDiff(&treeDiff)
+		return nil
+	}
+
+	toPath := filePath
+	if toID != "" {
+		toPath = filepath.Join(fileDir, toID)
+	}
+	diffRes, err := version.FileDiffWithOptions(filepath.Join(fileDir, fromID), toPath, diffOptions(filePath))
+	if err != nil {
+		return err
+	}
+	diffRes.OldName = diffLabel("a", path)
+	diffRes.NewName = diffLabel("b", path)
+	return printDiff(&diffRes)
+}
+
+func printDiff(diffRes *version.DiffResult) error {
+	opts := version.DefaultRenderOptions()
+	opts.Format = diffFormat
+	opts.WordDiff = diffWordDiff
+
+	stdout := int(os.Stdout.Fd())
+	switch diffColor {
+	case "always":
+		opts.Color = true
+	case "never":
+		opts.Color = false
+	case "auto":
+		opts.Color = term.IsTerminal(stdout) && os.Getenv("NO_COLOR") == ""
+	default:
+		return fmt.Errorf("invalid --color value %q: use auto, always or never", diffColor)
+	}
+
+	if width, _, err := term.GetSize(stdout); err == nil && width > 0 {
+		opts.Width = width
+	} else if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		opts.Width = columns
+	}
+
+	return version.PrintDiffResultsWithOptions(diffRes, opts)
+}
+
+func diffOptions(name string) version.DiffOptions {
+	opts := version.DefaultDiffOptions()
+	opts.Context = diffContext
+	opts.Hex = diffHex
+	opts.Semantic = diffSemantic
+	opts.Syntax = version.DetectSyntax(name)
+	return opts
+}
+
+// diffLabel builds the a/ and b/ style names used in the diff header so the
+// output can be fed to patch -p1 or git apply.
+func diffLabel(prefix, path string) string {
+	return prefix + "/" + strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "/")
+}
+
+func diffLastSnapshot(dirPath, fileDir string) error {
+	list, err := version.ListAllVersions(fileDir)
+	if err != nil {
+		return fmt.Errorf("No last version found. Make a version first to check")
+	}
+	if len(*list) == 0 {
+		return fmt.Errorf("No last version found. Make a version first to check")
+	}
+	last := (*list)[len(*list)-1]
+	treeDiff, err := version.DiffSnapshot(fileDir, last.ID, "", dirPath)
+	if err != nil {
+		return err
+	}
+	version.PrintTreeDiff(&treeDiff)
+	return nil
+}
+
+func isDirectory(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func mergeVersion(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	versionDir, err := version.GetVersionPath(filePath)
+	if err != nil {
+		return err
+	}
+	id, err := version.ResolveVersion(versionDir, args[1])
+	if err != nil {
+		return err
+	}
+	result, err := version.MergeFile(versionDir, id, filePath)
+	if errors.Is(err, version.ErrMergeConflict) {
+		return fmt.Errorf(
+			"merge of %s (base %s) left %d conflicts, fix them in %s",
+			id, result.Base, result.Conflicts, args[0],
+		)
+	}
+	if err != nil {
+		return err
+	}
+	if result.UpToDate {
+		fmt.Printf("Already up to date: %s is based on %s\n", args[0], result.Head)
+		return nil
+	}
+	fmt.Printf("Merged version %s into %s (base %s)\n", id, args[0], result.Base)
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func tagVersion(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	versionDir, err := version.GetVersionPath(filePath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case deleteTag:
+		if len(args) != 2 {
+			return fmt.Errorf("usage: version tag --delete [filepath] [name]")
+		}
+		if err := version.DeleteTag(versionDir, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Tag %s deleted\n", args[1])
+	case len(args) == 1:
+		tags, err := version.ListTags(versionDir)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(tags))
+		for name := range tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s -> %s\n", name, tags[name])
+		}
+	case len(args) == 3:
+		id, err := version.ResolveVersion(versionDir, args[1])
+		if err != nil {
+			return err
+		}
+		if err := version.TagVersion(versionDir, id, args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("Version %s tagged as %s\n", id, args[2])
+	default:
+		return fmt.Errorf("usage: version tag [filepath] [versionID] [name]")
+	}
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func removeVersion(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	fileDir, err := version.GetVersionPath(filePath)
+	if err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("version") {
+		id, err := version.ResolveVersion(fileDir, versionToRemove)
+		if err != nil {
+			return err
+		}
+		err = version.ClearVersion(fileDir, id)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Version with verisonID %s is cleared", id)
+	} else {
+		err := version.ClearAllVersion(fileDir)
+		if err != nil {
+			return err
+		}
+		fmt.Println("All versions of this file are now cleared")
+	}
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func pruneVersions(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	fileDir, err := version.GetVersionPath(filePath)
+	if err != nil {
+		return err
+	}
+
+	if pruneClearPolicy {
+		if err := version.SavePolicy(fileDir, version.RetentionPolicy{}); err != nil {
+			return err
+		}
+		fmt.Println("Retention policy removed")
+		return nil
+	}
+
+	policy := prunePolicy
+	if policy.IsZero() {
+		if pruneSave {
+			return fmt.Errorf("--save needs at least one policy flag")
+		}
+		policy, err = version.LoadPolicy(fileDir)
+		if err != nil {
+			return err
+		}
+		if policy.IsZero() {
+			return fmt.Errorf("no retention policy given and none saved for %s", args[0])
+		}
+	}
+	if pruneSave {
+		if err := version.SavePolicy(fileDir, policy); err != nil {
+			return err
+		}
+		fmt.Println("Retention policy saved")
+	}
+
+	plan, err := version.Prune(fileDir, policy, pruneDryRun)
+	if err != nil {
+		return err
+	}
+	action := "Removed"
+	if pruneDryRun {
+		action = "Would remove"
+	}
+	for _, entry := range plan.Remove {
+		fmt.Printf("%s %s  %s  %s (%s)\n", action, entry.Version.ID,
+			entry.Version.CreatedAt.Format("2006-01-02 15:04"), entry.Version.Message, entry.Reason)
+	}
+	if pruneDryRun {
+		for _, entry := range plan.Keep {
+			fmt.Printf("Keep %s  %s  %s (%s)\n", entry.Version.ID,
+				entry.Version.CreatedAt.Format("2006-01-02 15:04"), entry.Version.Message, entry.Reason)
+		}
+	}
+	fmt.Printf("%s %d versions, keeping %d\n", action, len(plan.Remove), len(plan.Keep))
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func versionConfig(cmd *cobra.Command, args []string) error {
+	switch len(args) {
+	case 0:
+		for _, key := range version.ConfigKeys() {
+			value, err := version.GetConfigValue(key)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s = %s\n", key, value)
+		}
+	case 1:
+		value, err := version.GetConfigValue(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+	default:
+		if err := version.SetConfigValue(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("%s set to %s\n", args[0], args[1])
+	}
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func repackVersions(cmd *cobra.Command, args []string) error {
+	result, err := version.Repack(repackMaxChain)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stored %d versions as deltas, %d whole again\n", result.Deltified, result.Materialized)
+	fmt.Printf("Store size: %d -> %d bytes\n", result.SizeBefore, result.SizeAfter)
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func versionStatus(cmd *cobra.Command, args []string) error {
+	statuses, err := version.Status()
+	if err != nil {
+		return err
+	}
+	if statusJSON {
+		if statuses == nil {
+			statuses = []version.FileStatus{}
+		}
+		jsonData, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jsonData))
+		return nil
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No tracked files")
+		return nil
+	}
+	var size, stored int64
+	for _, status := range statuses {
+		fmt.Printf("%-9s  %-5s  %3d versions  %10d bytes  %10d stored  %s\n", status.State,
+			status.Base, status.Versions, status.Size, status.StoredSize, status.Path)
+		size += status.Size
+		stored += status.StoredSize
+	}
+	fmt.Printf("%d tracked, %d bytes in versions, %d bytes stored\n", len(statuses), size, stored)
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func exportHistory(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	output := exportOutput
+	if output == "" {
+		output = filepath.Base(filePath) + ".gdxb"
+	}
+	if output == "-" {
+		_, err := version.ExportHistory(filePath, os.Stdout)
+		return err
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	count, err := version.ExportHistory(filePath, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	fmt.Printf("Exported %d versions of %s to %s\n", count, filePath, output)
+	return nil
+}
+
+func importHistory(cmd *cobra.Command, args []string) error {
+	input := os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+	target := ""
+	if importAs != "" {
+		var err error
+		if target, err = filepath.Abs(importAs); err != nil {
+			return err
+		}
+	}
+	path, count, err := version.ImportHistory(input, target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d versions of %s\n", count, path)
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func annotateVersion(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	versionDir, err := version.GetVersionPath(filePath)
+	if err != nil {
+		return err
+	}
+	id, err := versionArg(versionDir, args, annotateAt, annotateAgo)
+	if err != nil {
+		return err
+	}
+
+	annotation := version.Annotation{Remove: annotateUnlabel}
+	if cmd.Flags().Changed("message") {
+		annotation.Message = &annotateMessage
+	}
+	for _, label := range annotateLabels {
+		key, value, err := version.ParseLabel(label)
+		if err != nil {
+			return err
+		}
+		if annotation.Set == nil {
+			annotation.Set = make(map[string]string)
+		}
+		annotation.Set[key] = value
+	}
+
+	var meta version.VersionMetaData
+	if annotation.Message == nil && len(annotation.Set) == 0 && len(annotation.Remove) == 0 {
+		if meta, err = version.FindVersion(versionDir, id); err != nil {
+			return err
+		}
+	} else {
+		if meta, err = version.AnnotateVersion(versionDir, id, annotation); err != nil {
+			return err
+		}
+		fmt.Printf("Version %s annotated\n", id)
+	}
+	fmt.Printf("Message: %s\n", meta.Message)
+	if meta.Author != "" || meta.Host != "" {
+		fmt.Printf("Author: %s\n", formatOrigin(meta))
+	}
+	if len(meta.Labels) > 0 {
+		fmt.Printf("Labels: %s\n", formatLabels(meta.Labels))
+	}
+	return nil
+}
+
+func searchLog(cmd *cobra.Command, args []string) error {
+	filter := version.LogFilter{Author: logAuthor}
+	if logGrep != "" {
+		grep, err := regexp.Compile(logGrep)
+		if err != nil {
+			return fmt.Errorf("invalid --grep expression: %w", err)
+		}
+		filter.Grep = grep
+	}
+	if logSince != "" {
+		since, err := version.ParseTime(logSince, time.Now())
+		if err != nil {
+			return err
+		}
+		filter.Since = since
+	}
+	for _, label := range logLabels {
+		key, value, _ := strings.Cut(label, "=")
+		if filter.Labels == nil {
+			filter.Labels = make(map[string]string)
+		}
+		filter.Labels[key] = value
+	}
+
+	entries, err := version.SearchLog(filter)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		meta := entry.Version
+		line := fmt.Sprintf("%-5s  %s  %-20s  %s  %s", meta.ID, meta.CreatedAt.Format("2006-01-02 15:04"),
+			formatOrigin(meta), entry.Path, meta.Message)
+		if len(meta.Labels) > 0 {
+			line += "  [" + formatLabels(meta.Labels) + "]"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func blameFile(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	versionDir, err := version.GetVersionPath(filePath)
+	if err != nil {
+		return err
+	}
+	id := ""
+	if len(args) == 2 {
+		if id, err = version.ResolveVersion(versionDir, args[1]); err != nil {
+			return err
+		}
+	}
+	lines, err := version.Blame(versionDir, id, filePath)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		meta := line.Version
+		if meta.ID == "" {
+			fmt.Printf("%-5s  %-16s  %-24s %5d) %s\n", "-", "", "not versioned yet", line.Number, line.Text)
+			continue
+		}
+		fmt.Printf("%-5s  %s  %-24.24s %5d) %s\n", meta.ID, meta.CreatedAt.Format("2006-01-02 15:04"),
+			meta.Message, line.Number, line.Text)
+	}
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func makePatch(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	versionDir, err := version.GetVersionPath(filePath)
+	if err != nil {
+		return err
+	}
+	fromID, err := version.ResolveVersion(versionDir, args[1])
+	if err != nil {
+		return err
+	}
+	toID := ""
+	if len(args) == 3 {
+		if toID, err = version.ResolveVersion(versionDir, args[2]); err != nil {
+			return err
+		}
+	}
+	patch, err := version.MakePatch(versionDir, fromID, toID, filePath, args[0], patchContext)
+	if err != nil {
+		return err
+	}
+	if patch == "" {
+		fmt.Fprintln(os.Stderr, "No differences, no patch written")
+		return nil
+	}
+	if patchOutput == "" || patchOutput == "-" {
+		fmt.Print(patch)
+		return nil
+	}
+	if err := os.WriteFile(patchOutput, []byte(patch), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Patch written to %s\n", patchOutput)
+	return nil
+}
+
+func applyPatch(cmd *cobra.Command, args []string) error {
+	filePath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	var patch []byte
+	if args[1] == "-" {
+		patch, err = io.ReadAll(os.Stdin)
+	} else {
+		patch, err = os.ReadFile(args[1])
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := version.ApplyPatch(filePath, patch, version.ApplyOptions{Fuzz: applyFuzz, DryRun: applyDryRun})
+	if err != nil {
+		return err
+	}
+	applied, rejected := 0, 0
+	for _, hunk := range result.Hunks {
+		switch {
+		case hunk.Status == version.HunkRejected:
+			rejected++
+			fmt.Printf("Hunk #%d rejected\n", hunk.Hunk)
+		case hunk.Status == version.HunkAlreadyApplied:
+			fmt.Printf("Hunk #%d already applied at %d\n", hunk.Hunk, hunk.Line)
+		case hunk.Offset != 0 || hunk.Fuzz != 0:
+			applied++
+			fmt.Printf("Hunk #%d applied at %d (offset %d lines, fuzz %d)\n", hunk.Hunk, hunk.Line, hunk.Offset, hunk.Fuzz)
+		default:
+			applied++
+		}
+	}
+
+	action := "Applied"
+	if applyDryRun {
+		action = "Would apply"
+	}
+	fmt.Printf("%s %d of %d hunks to %s\n", action, applied, len(result.Hunks), args[0])
+	if rejected == 0 {
+		return nil
+	}
+	if applyDryRun {
+		return fmt.Errorf("%d hunks would be rejected", rejected)
+	}
+	rejectFile := applyRejectFile
+	if rejectFile == "" {
+		rejectFile = filePath + ".rej"
+	}
+	if err := os.WriteFile(rejectFile, []byte(result.Rejected), 0644); err != nil {
+		return err
+	}
+	return fmt.Errorf("%d hunks rejected, saved to %s", rejected, rejectFile)
+}
+
+// formatOrigin shows who created a version where as author@host.
+func formatOrigin(meta version.VersionMetaData) string {
+	switch {
+	case meta.Author == "" && meta.Host == "":
+		return "-"
+	case meta.Host == "":
+		return meta.Author
+	}
+	return meta.Author + "@" + meta.Host
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func checkStore(cmd *cobra.Command, args []string) error {
+	report, err := version.Fsck(fsckRepair)
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Printf("%-18s  %s: %s\n", problem.Kind, problem.Subject, problem.Detail)
+	}
+	fmt.Printf("Checked %d files, %d versions, %d manifests and %d chunks\n",
+		report.Files, report.Versions, report.Manifests, report.Chunks)
+	if report.Unreferenced > 0 {
+		fmt.Printf("%d manifests are not referenced by any version\n", report.Unreferenced)
+	}
+	if len(report.Problems) == 0 {
+		fmt.Println("No problems found")
+		return nil
+	}
+	if !fsckRepair {
+		return fmt.Errorf("found %d problems, run with --repair to fix them", len(report.Problems))
+	}
+
+	for _, repair := range report.Repairs {
+		fmt.Println("repaired: " + repair)
+	}
+	// check again to tell what could not be fixed
+	after, err := version.Fsck(false)
+	if err != nil {
+		return err
+	}
+	for _, problem := range after.Problems {
+		fmt.Printf("%-18s  %s: %s\n", problem.Kind, problem.Subject, problem.Detail)
+	}
+	if len(after.Problems) > 0 {
+		return fmt.Errorf("%d problems remain after repairing", len(after.Problems))
+	}
+	fmt.Printf("Repaired %d problems\n", len(report.Problems))
+	return nil
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////////////////
+func readPassphrase(prompt string) ([]byte, error) {
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, version.ErrStoreLocked
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+func newKeySource() (version.KeySource, error) {
+	if encryptKeyFile != "" {
+		keyFile, err := filepath.Abs(encryptKeyFile)
+		return version.KeySource{KeyFile: keyFile}, err
+	}
+	if passphrase := os.Getenv("GODEX_NEW_PASSPHRASE"); passphrase != "" {
+		return version.KeySource{Passphrase: []byte(passphrase)}, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return version.KeySource{}, fmt.Errorf("set GODEX_NEW_PASSPHRASE or use --key-file")
+	}
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return version.KeySource{}, err
+	}
+	confirm, err := readPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return version.KeySource{}, err
+	}
+	if string(passphrase) != string(confirm) {
+		return version.KeySource{}, fmt.Errorf("passphrases do not match")
+	}
+	if len(passphrase) == 0 {
+		return version.KeySource{}, fmt.Errorf("empty passphrase")
+	}
+	return version.KeySource{Passphrase: passphrase}, nil
+}
+
+func encryptStore(cmd *cobra.Command, args []string) error {
+	source, err := newKeySource()
+	if err != nil {
+		return err
+	}
+	if err := version.EnableEncryption(source); err != nil {
+		return err
+	}
+	fmt.Println("The version store is now encrypted")
+	return nil
+}
+
+func rekeyStore(cmd *cobra.Command, args []string) error {
+	// unlock with the current key before asking for the new one
+	if err := version.Unlock(); err != nil {
+		return err
+	}
+	source, err := newKeySource()
+	if err != nil {
+		return err
+	}
+	if err := version.Rekey(source); err != nil {
+		return err
 	}
+	fmt.Println("The version store was re-encrypted with the new key")
 	return nil
 }
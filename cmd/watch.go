@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.inodinwetrust10/godex/pkg/version"
+)
+
+var (
+	watchOptions version.WatchOptions
+	watchCmd     = &cobra.Command{
+		Use:   "watch [paths...]",
+		Short: "Create versions of files automatically when they are saved",
+		Long: `Watch files and directories and create a version of a file once it settles after a
+write. Directories are watched recursively; the files in them are filtered with
+--include and --exclude globs, which match the file name or the path relative to the
+watched directory. Files named on the command line are always watched. Versions
+created this way are marked as auto versions, which version prune can limit with
+--auto-keep-last and --auto-max-age. Stop watching with Ctrl+C.`,
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE:         watchFiles,
+	}
+)
+
+func init() {
+	watchCmd.Flags().
+		DurationVar(&watchOptions.Debounce, "debounce", 2*time.Second, "How long a file must be quiet before it gets a version")
+	watchCmd.Flags().
+		DurationVar(&watchOptions.MinInterval, "min-interval", time.Minute, "Shortest time between two versions of a file")
+	watchCmd.Flags().
+		StringSliceVar(&watchOptions.Include, "include", nil, "Only version files matching these globs")
+	watchCmd.Flags().
+		StringSliceVar(&watchOptions.Exclude, "exclude", version.DefaultWatchExcludes, "Skip files and directories matching these globs")
+	watchCmd.Flags().StringVarP(&watchOptions.Message, "message", "m", "auto-save", "Message of the created versions")
+	rootCmd.AddCommand(watchCmd)
+}
+
+func watchFiles(cmd *cobra.Command, args []string) error {
+	var paths []string
+	for _, arg := range args {
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	// ask for the key now rather than at the first save
+	if err := version.Unlock(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprintf(os.Stderr, "Watching %d paths, press Ctrl+C to stop\n", len(paths))
+	return version.Watch(ctx, paths, watchOptions, func(event version.WatchEvent) {
+		if event.Err != nil && event.Path == "" {
+			fmt.Fprintln(os.Stderr, event.Err)
+			return
+		}
+		if event.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", event.Path, event.Err)
+			return
+		}
+		fmt.Printf("%s  %s  %s\n", event.Version.CreatedAt.Format("15:04:05"), event.Version.ID, event.Path)
+	})
+}
@@ -0,0 +1,174 @@
+package version
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every version records who created it and on which host. Messages can be
+// changed afterwards and labels (key=value pairs such as a ticket ID) added, and
+// the log searches both across all tracked files.
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// versionOrigin returns the author and host recorded with a new version. The
+// author is GODEX_AUTHOR when set, otherwise the current user.
+func versionOrigin() (string, string) {
+	author := os.Getenv("GODEX_AUTHOR")
+	if author == "" {
+		if current, err := user.Current(); err == nil {
+			author = current.Username
+		} else {
+			author = os.Getenv("USER")
+		}
+	}
+	host, _ := os.Hostname()
+	return author, host
+}
+
+// ParseLabel splits a key=value label.
+func ParseLabel(label string) (string, string, error) {
+	key, value, ok := strings.Cut(label, "=")
+	if !ok || !labelKeyPattern.MatchString(key) {
+		return "", "", fmt.Errorf("invalid label %q: use key=value", label)
+	}
+	return key, value, nil
+}
+
+// Annotation is a change to the message and labels of a version. A nil
+// Message leaves the message alone.
+type Annotation struct {
+	Message *string
+	Set     map[string]string
+	Remove  []string
+}
+
+// AnnotateVersion applies an annotation to a version and returns the result.
+func AnnotateVersion(versionDir, versionID string, annotation Annotation) (VersionMetaData, error) {
+	for key := range annotation.Set {
+		if !labelKeyPattern.MatchString(key) {
+			return VersionMetaData{}, fmt.Errorf("invalid label key %q", key)
+		}
+	}
+	var annotated VersionMetaData
+	err := withLocks(versionDir, false, func() error {
+		found := false
+		err := withIndex(true, func(tx *bolt.Tx) error {
+			return updateVersions(tx, versionDir, func(meta VersionMetaData) (VersionMetaData, bool) {
+				if meta.ID != versionID {
+					return meta, true
+				}
+				found = true
+				if annotation.Message != nil {
+					meta.Message = *annotation.Message
+				}
+				labels := make(map[string]string)
+				for key, value := range meta.Labels {
+					labels[key] = value
+				}
+				for _, key := range annotation.Remove {
+					delete(labels, key)
+				}
+				for key, value := range annotation.Set {
+					labels[key] = value
+				}
+				meta.Labels = nil
+				if len(labels) > 0 {
+					meta.Labels = labels
+				}
+				annotated = meta
+				return meta, true
+			})
+		})
+		if err == nil && !found {
+			return fmt.Errorf("version %s does not exist", versionID)
+		}
+		return err
+	})
+	return annotated, err
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// LogFilter selects versions for the log. Grep is matched against the message
+// and the labels, Author against author@host, ignoring case. Zero fields match
+// everything.
+type LogFilter struct {
+	Grep   *regexp.Regexp
+	Author string
+	Since  time.Time
+	Labels map[string]string
+}
+
+type LogEntry struct {
+	Path    string
+	Version VersionMetaData
+}
+
+func (f LogFilter) matches(meta VersionMetaData) bool {
+	if meta.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if f.Author != "" {
+		origin := strings.ToLower(meta.Author + "@" + meta.Host)
+		if !strings.Contains(origin, strings.ToLower(f.Author)) {
+			return false
+		}
+	}
+	for key, value := range f.Labels {
+		if label, ok := meta.Labels[key]; !ok || (value != "" && label != value) {
+			return false
+		}
+	}
+	if f.Grep == nil || f.Grep.MatchString(meta.Message) {
+		return true
+	}
+	for key, value := range meta.Labels {
+		if f.Grep.MatchString(key + "=" + value) {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchLog returns the versions of all tracked files that pass filter, newest
+// first.
+func SearchLog(filter LogFilter) ([]LogEntry, error) {
+	var entries []LogEntry
+	err := withIndex(false, func(tx *bolt.Tx) error {
+		files := tx.Bucket(bucketFiles)
+		if files == nil {
+			return nil
+		}
+		return files.ForEach(func(name, _ []byte) error {
+			bucket := files.Bucket(name)
+			if bucket == nil {
+				return nil
+			}
+			versions, err := loadVersions(tx, string(name))
+			if err != nil && !errors.Is(err, errNoVersions) {
+				return err
+			}
+			path := string(bucket.Get(keyPath))
+			for _, meta := range versions {
+				if filter.matches(meta) {
+					entries = append(entries, LogEntry{Path: path, Version: meta})
+				}
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Version.CreatedAt.After(entries[j].Version.CreatedAt)
+	})
+	return entries, err
+}
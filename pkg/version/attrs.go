@@ -0,0 +1,103 @@
+package version
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// File versions record the mode, owner, modification time and extended
+// attributes of the file and restores put them back. Ownership and extended
+// attributes the process may not set are skipped. The modification time is
+// restored but never counts as a change, so touching a file is not a new
+// version.
+
+const restorableMode = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+func readAttrs(path string) (*FileAttrs, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	attrs := &FileAttrs{
+		Mode:    info.Mode(),
+		UID:     -1,
+		GID:     -1,
+		ModTime: info.ModTime(),
+	}
+	if err := readPlatformAttrs(path, info, attrs); err != nil {
+		return nil, fmt.Errorf("failed to read attributes of %s: %w", path, err)
+	}
+	return attrs, nil
+}
+
+func applyAttrs(path string, attrs *FileAttrs) error {
+	if attrs == nil {
+		return nil
+	}
+	if err := applyPlatformAttrs(path, attrs); err != nil {
+		return fmt.Errorf("failed to restore attributes of %s: %w", path, err)
+	}
+	// chown clears the setuid and setgid bits, so the mode comes after it
+	if err := os.Chmod(path, attrs.Mode&restorableMode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", path, err)
+	}
+	if err := os.Chtimes(path, attrs.ModTime, attrs.ModTime); err != nil {
+		return fmt.Errorf("failed to set times of %s: %w", path, err)
+	}
+	return nil
+}
+
+// attrChanges describes how the attributes of new differ from old, leaving
+// out the modification time. Nothing is reported when either side is unknown.
+func attrChanges(old, new *FileAttrs) []string {
+	if old == nil || new == nil {
+		return nil
+	}
+	var changes []string
+	if old.Mode&restorableMode != new.Mode&restorableMode {
+		changes = append(changes, fmt.Sprintf("mode %s -> %s", old.Mode&restorableMode, new.Mode&restorableMode))
+	}
+	if (old.UID != new.UID || old.GID != new.GID) && old.UID >= 0 && new.UID >= 0 {
+		changes = append(changes, fmt.Sprintf("owner %d:%d -> %d:%d", old.UID, old.GID, new.UID, new.GID))
+	}
+
+	names := make(map[string]bool)
+	for name := range old.Xattrs {
+		names[name] = true
+	}
+	for name := range new.Xattrs {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		oldValue, inOld := old.Xattrs[name]
+		newValue, inNew := new.Xattrs[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("xattr %s added", name))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("xattr %s removed", name))
+		case !bytes.Equal(oldValue, newValue):
+			changes = append(changes, fmt.Sprintf("xattr %s changed", name))
+		}
+	}
+	return changes
+}
+
+// pathAttrs returns the attributes of a file, or of a version for a version
+// path as returned by ReturnLastFilePath.
+func pathAttrs(path string) (*FileAttrs, error) {
+	if versionIDPattern.MatchString(filepath.Base(path)) {
+		if meta, err := FindVersion(filepath.Dir(path), filepath.Base(path)); err == nil {
+			return meta.Attrs, nil
+		}
+	}
+	return readAttrs(path)
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package version
+
+import "os"
+
+// only the mode and modification time are recorded here
+
+func readPlatformAttrs(path string, info os.FileInfo, attrs *FileAttrs) error {
+	return nil
+}
+
+func applyPlatformAttrs(path string, attrs *FileAttrs) error {
+	return nil
+}
@@ -0,0 +1,105 @@
+//go:build linux || darwin
+
+package version
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func readPlatformAttrs(path string, info os.FileInfo, attrs *FileAttrs) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		attrs.UID = int(stat.Uid)
+		attrs.GID = int(stat.Gid)
+	}
+
+	names, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		valueSize, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			if unsupportedXattr(err) {
+				continue
+			}
+			return err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Getxattr(path, name, value); err != nil {
+			return err
+		}
+		if attrs.Xattrs == nil {
+			attrs.Xattrs = make(map[string][]byte)
+		}
+		attrs.Xattrs[name] = value[:valueSize]
+	}
+	return nil
+}
+
+func applyPlatformAttrs(path string, attrs *FileAttrs) error {
+	if attrs.UID >= 0 && attrs.GID >= 0 {
+		if err := os.Chown(path, attrs.UID, attrs.GID); err != nil && !errors.Is(err, os.ErrPermission) {
+			return err
+		}
+	}
+	for name, value := range attrs.Xattrs {
+		if err := unix.Setxattr(path, name, value, 0); err != nil &&
+			!errors.Is(err, os.ErrPermission) && !unsupportedXattr(err) {
+			return err
+		}
+	}
+
+	// attributes the version does not have are removed, except those of the
+	// security modules, which the system keeps itself
+	names, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := attrs.Xattrs[name]; ok || strings.HasPrefix(name, "security.") {
+			continue
+		}
+		if err := unix.Removexattr(path, name); err != nil &&
+			!errors.Is(err, os.ErrPermission) && !unsupportedXattr(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listXattrs returns the names of the extended attributes of path, none where
+// the file system does not support them.
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil {
+		if unsupportedXattr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	list := make([]byte, size)
+	if size, err = unix.Listxattr(path, list); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(list[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// unsupportedXattr tells whether the file system or the attribute namespace
+// does not allow extended attributes here.
+func unsupportedXattr(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENODATA)
+}
@@ -0,0 +1,57 @@
+//go:build linux || darwin
+
+package version
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Restoring a version sets the extended attributes it recorded and removes
+// those it did not have.
+func TestRestoreFileReplacesXattrs(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	filePath := filepath.Join(t.TempDir(), "x.txt")
+	if err := os.WriteFile(filePath, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(filePath, "user.kept", []byte("v1"), 0); err != nil {
+		t.Skipf("extended attributes are not supported here: %v", err)
+	}
+	if _, err := CreateFile(filePath, "", "one"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.Setxattr(filePath, "user.kept", []byte("changed"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(filePath, "user.added", []byte("later"), 0); err != nil {
+		t.Fatal(err)
+	}
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreFile(versionDir, "v1", filePath); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := listXattrs(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "user.kept" {
+		t.Errorf("attributes after the restore are %v, want [user.kept]", names)
+	}
+	value := make([]byte, 16)
+	size, err := unix.Getxattr(filePath, "user.kept", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value[:size]) != "v1" {
+		t.Errorf("user.kept is %q, want %q", value[:size], "v1")
+	}
+}
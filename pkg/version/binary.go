@@ -0,0 +1,313 @@
+package version
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// like git only the first 8000 bytes are looked at
+	binarySniffLength = 8000
+	// ranges closer than this are reported as one
+	byteRangeGap = 8
+	// at most this many bytes of each side of a range go into the hex dump
+	hexDumpLimit = 256
+)
+
+// isBinary reports content with a NUL byte or invalid UTF-8 near the start as
+// binary. A rune cut in half at the end of the sniffed prefix is ignored.
+func isBinary(content []byte) bool {
+	sniff := content[:min(len(content), binarySniffLength)]
+	if bytes.IndexByte(sniff, 0) >= 0 {
+		return true
+	}
+	for i := 0; i < utf8.UTFMax && len(sniff) > 0 && len(sniff) < len(content); i++ {
+		if utf8.Valid(sniff) {
+			return false
+		}
+		sniff = sniff[:len(sniff)-1]
+	}
+	return !utf8.Valid(sniff)
+}
+
+func diffBinary(content1, content2 []byte, opts DiffOptions) DiffResult {
+	result := DiffResult{
+		DiffLines: []LineDiff{},
+		OldSize:   int64(len(content1)),
+		NewSize:   int64(len(content2)),
+	}
+
+	if kind := archiveKind(content1); kind != "" && kind == archiveKind(content2) {
+		entries, err := diffArchives(kind, content1, content2)
+		if err == nil {
+			result.DiffType = "archive"
+			result.Entries = entries
+			result.Message = fmt.Sprintf("%s archives differ in %d entries", kind, len(entries))
+			return result
+		}
+		// a damaged archive is still worth a byte level summary
+	}
+
+	result.DiffType = "binary"
+	result.ByteRanges = diffByteRanges(content1, content2)
+	if opts.Hex {
+		for i := range result.ByteRanges {
+			r := &result.ByteRanges[i]
+			r.OldBytes = content1[r.OldOffset : r.OldOffset+min(r.OldLength, hexDumpLimit)]
+			r.NewBytes = content2[r.NewOffset : r.NewOffset+min(r.NewLength, hexDumpLimit)]
+		}
+	}
+
+	changed := int64(0)
+	for _, r := range result.ByteRanges {
+		changed += max(r.OldLength, r.NewLength)
+	}
+	result.Message = fmt.Sprintf("Binary files differ: %d ranges, %d bytes changed", len(result.ByteRanges), changed)
+	return result
+}
+
+// diffByteRanges strips the common prefix and suffix. When both sides keep the
+// same length the middle is compared byte by byte so in-place edits show up as
+// separate ranges, otherwise the middle is reported as one replaced range.
+func diffByteRanges(content1, content2 []byte) []ByteRange {
+	prefix := 0
+	for prefix < len(content1) && prefix < len(content2) && content1[prefix] == content2[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(content1)-prefix && suffix < len(content2)-prefix &&
+		content1[len(content1)-1-suffix] == content2[len(content2)-1-suffix] {
+		suffix++
+	}
+
+	if len(content1) != len(content2) {
+		return []ByteRange{{
+			OldOffset: int64(prefix),
+			OldLength: int64(len(content1) - prefix - suffix),
+			NewOffset: int64(prefix),
+			NewLength: int64(len(content2) - prefix - suffix),
+		}}
+	}
+
+	var ranges []ByteRange
+	end := len(content1) - suffix
+	for i := prefix; i < end; {
+		if content1[i] == content2[i] {
+			i++
+			continue
+		}
+		start := i
+		last := i
+		for i < end && i-last <= byteRangeGap {
+			if content1[i] != content2[i] {
+				last = i
+			}
+			i++
+		}
+		length := int64(last - start + 1)
+		ranges = append(ranges, ByteRange{
+			OldOffset: int64(start),
+			OldLength: length,
+			NewOffset: int64(start),
+			NewLength: length,
+		})
+		i = last + 1
+	}
+	return ranges
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func archiveKind(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")), bytes.HasPrefix(content, []byte("PK\x05\x06")):
+		return "zip"
+	case len(content) > 262 && string(content[257:262]) == "ustar":
+		return "tar"
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return ""
+		}
+		defer reader.Close()
+		header := make([]byte, 262)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return ""
+		}
+		if string(header[257:262]) == "ustar" {
+			return "tar.gz"
+		}
+	}
+	return ""
+}
+
+type archiveEntry struct {
+	size int64
+	// sum is the CRC32 for zip members and the SHA-256 of the content for tar
+	sum string
+}
+
+func readArchive(kind string, content []byte) (map[string]archiveEntry, error) {
+	entries := make(map[string]archiveEntry)
+
+	if kind == "zip" {
+		reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range reader.File {
+			entries[file.Name] = archiveEntry{
+				size: int64(file.UncompressedSize64),
+				sum:  fmt.Sprintf("%08x", file.CRC32),
+			}
+		}
+		return entries, nil
+	}
+
+	var source io.Reader = bytes.NewReader(content)
+	if kind == "tar.gz" {
+		gz, err := gzip.NewReader(source)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		source = gz
+	}
+
+	reader := tar.NewReader(source)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, reader); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(hasher, "%o %s", header.Mode, header.Linkname)
+		entries[header.Name] = archiveEntry{
+			size: header.Size,
+			sum:  hex.EncodeToString(hasher.Sum(nil)),
+		}
+	}
+	return entries, nil
+}
+
+func diffArchives(kind string, content1, content2 []byte) ([]EntryChange, error) {
+	oldEntries, err := readArchive(kind, content1)
+	if err != nil {
+		return nil, err
+	}
+	newEntries, err := readArchive(kind, content2)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []EntryChange
+	for name, old := range oldEntries {
+		current, ok := newEntries[name]
+		switch {
+		case !ok:
+			changes = append(changes, EntryChange{Name: name, Status: "removed", OldSize: old.size})
+		case current.sum != old.sum || current.size != old.size:
+			changes = append(changes, EntryChange{
+				Name:    name,
+				Status:  "modified",
+				OldSize: old.size,
+				NewSize: current.size,
+			})
+		}
+	}
+	for name, current := range newEntries {
+		if _, ok := oldEntries[name]; !ok {
+			changes = append(changes, EntryChange{Name: name, Status: "added", NewSize: current.size})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes, nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func renderBinary(result DiffResult, opts RenderOptions) string {
+	var sb strings.Builder
+	sb.WriteString(opts.paint(fmt.Sprintf("Binary files %s and %s differ", result.OldName, result.NewName), styleHeader) + "\n")
+	sb.WriteString(fmt.Sprintf("Size: %d -> %d bytes\n", result.OldSize, result.NewSize))
+
+	if result.DiffType == "archive" {
+		for _, entry := range result.Entries {
+			switch entry.Status {
+			case "added":
+				sb.WriteString(opts.paint(fmt.Sprintf("A  %s (%d bytes)", entry.Name, entry.NewSize), styleInsert) + "\n")
+			case "removed":
+				sb.WriteString(opts.paint(fmt.Sprintf("D  %s (%d bytes)", entry.Name, entry.OldSize), styleDelete) + "\n")
+			case "modified":
+				sb.WriteString(fmt.Sprintf("M  %s (%d -> %d bytes)\n", entry.Name, entry.OldSize, entry.NewSize))
+			}
+		}
+		sb.WriteString(fmt.Sprintf("\nTotal changed entries: %d\n", len(result.Entries)))
+		return sb.String()
+	}
+
+	for _, r := range result.ByteRanges {
+		sb.WriteString(opts.paint(fmt.Sprintf("@@ 0x%08x,%d 0x%08x,%d @@", r.OldOffset, r.OldLength, r.NewOffset, r.NewLength), styleHunk) + "\n")
+		if r.OldBytes == nil && r.NewBytes == nil {
+			continue
+		}
+		sb.WriteString(hexDump(r.OldBytes, r.OldOffset, "-", styleDelete, opts))
+		if int64(len(r.OldBytes)) < r.OldLength {
+			sb.WriteString(fmt.Sprintf("- ... %d more bytes\n", r.OldLength-int64(len(r.OldBytes))))
+		}
+		sb.WriteString(hexDump(r.NewBytes, r.NewOffset, "+", styleInsert, opts))
+		if int64(len(r.NewBytes)) < r.NewLength {
+			sb.WriteString(fmt.Sprintf("+ ... %d more bytes\n", r.NewLength-int64(len(r.NewBytes))))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("\n%s\n", result.Message))
+	return sb.String()
+}
+
+// hexDump prints data in the layout of xxd: offset, 16 bytes in hex and the
+// printable characters.
+func hexDump(data []byte, offset int64, prefix, style string, opts RenderOptions) string {
+	var sb strings.Builder
+	for i := 0; i < len(data); i += 16 {
+		row := data[i:min(i+16, len(data))]
+
+		var hexPart, textPart strings.Builder
+		for j := 0; j < 16; j++ {
+			if j < len(row) {
+				hexPart.WriteString(fmt.Sprintf("%02x", row[j]))
+				if row[j] >= 0x20 && row[j] < 0x7f {
+					textPart.WriteByte(row[j])
+				} else {
+					textPart.WriteByte('.')
+				}
+			} else {
+				hexPart.WriteString("  ")
+			}
+			if j%2 == 1 {
+				hexPart.WriteByte(' ')
+			}
+		}
+
+		line := fmt.Sprintf("%s%08x: %s %s", prefix, offset+int64(i), hexPart.String(), textPart.String())
+		sb.WriteString(opts.paint(line, style) + "\n")
+	}
+	return sb.String()
+}
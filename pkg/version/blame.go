@@ -0,0 +1,128 @@
+package version
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Blame follows the parents of a version back to the first one and diffs each
+// version against the one before it. A line keeps the version it came from for
+// as long as it stays unchanged, so every line ends up with the version that
+// last changed it.
+
+// BlameLine is one line with the version that last changed it. Version is
+// zero for lines of the working copy that are not part of a version yet.
+type BlameLine struct {
+	Number  int
+	Text    string
+	Version VersionMetaData
+}
+
+// Blame labels the lines of versionID, or of the working copy at workingPath
+// when versionID is empty. The working copy is compared with the version it
+// is based on.
+func Blame(versionDir, versionID, workingPath string) ([]BlameLine, error) {
+	var lines []BlameLine
+	err := withLocks("", false, func() error {
+		var err error
+		lines, err = blame(versionDir, versionID, workingPath)
+		return err
+	})
+	return lines, err
+}
+
+func blame(versionDir, versionID, workingPath string) ([]BlameLine, error) {
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(*versions) == 0 {
+		return nil, errNoVersions
+	}
+	byID := make(map[string]VersionMetaData, len(*versions))
+	for _, meta := range *versions {
+		byID[meta.ID] = meta
+	}
+
+	start := versionID
+	if start == "" {
+		start = readHead(versionDir)
+		if _, ok := byID[start]; !ok {
+			start = (*versions)[len(*versions)-1].ID
+		}
+	}
+	if _, ok := byID[start]; !ok {
+		return nil, fmt.Errorf("version %s does not exist", start)
+	}
+	if byID[start].IsDir {
+		return nil, fmt.Errorf("version %s is a directory snapshot, only files can be blamed", start)
+	}
+
+	// oldest first
+	parents := parentIDs(*versions)
+	var chain []VersionMetaData
+	for id := start; id != ""; id = parents[id] {
+		chain = append([]VersionMetaData{byID[id]}, chain...)
+	}
+
+	var lines []string
+	var owners []VersionMetaData
+	for _, meta := range chain {
+		if meta.IsDir {
+			// a snapshot taken of the same path in between has no lines to give
+			lines, owners = nil, nil
+			continue
+		}
+		content, err := readContent(filepath.Join(versionDir, meta.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read version %s: %w", meta.ID, err)
+		}
+		if lines, owners, err = blameStep(lines, owners, content, meta); err != nil {
+			return nil, err
+		}
+	}
+	if versionID == "" {
+		content, err := os.ReadFile(workingPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read working copy: %w", err)
+		}
+		if lines, owners, err = blameStep(lines, owners, content, VersionMetaData{}); err != nil {
+			return nil, err
+		}
+	}
+
+	blamed := make([]BlameLine, len(lines))
+	for i, line := range lines {
+		blamed[i] = BlameLine{Number: i + 1, Text: strings.TrimSuffix(line, "\n"), Version: owners[i]}
+	}
+	return blamed, nil
+}
+
+// blameStep moves the owners of lines over to content. Lines that content
+// adds or changes are owned by meta.
+func blameStep(lines []string, owners []VersionMetaData, content []byte, meta VersionMetaData) ([]string, []VersionMetaData, error) {
+	if isBinary(content) {
+		return nil, nil, fmt.Errorf("cannot blame binary content")
+	}
+	next := splitLines(string(content))
+	edits, err := diffTokens(lines, next)
+	if err != nil {
+		return nil, nil, err
+	}
+	nextOwners := make([]VersionMetaData, 0, len(next))
+	old := 0
+	for _, edit := range edits {
+		switch edit.Op {
+		case LineEqual:
+			nextOwners = append(nextOwners, owners[old])
+			old++
+		case LineDelete:
+			old++
+		case LineInsert:
+			nextOwners = append(nextOwners, meta)
+		}
+	}
+	return next, nextOwners, nil
+}
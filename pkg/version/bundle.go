@@ -0,0 +1,381 @@
+package version
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A bundle carries the whole history of one file to another store:
+//
+//	"GDXB" format version (1 byte) then, gzip compressed,
+//	uvarint(length) header JSON
+//	uvarint(length) checksum uvarint(size) content ...
+//
+// Every piece of content appears once and whole, so a bundle does not depend
+// on chunking, compression, deltas or encryption of either store. Content is
+// checked against its checksum while it is imported.
+
+const bundleFormat = 1
+
+var bundleMagic = []byte("GDXB")
+
+type bundleHeader struct {
+	Path     string
+	Head     string `json:",omitempty"`
+	Versions []VersionMetaData
+	Tags     map[string]string `json:",omitempty"`
+}
+
+// ExportHistory writes the history of filePath to w as a bundle and returns
+// the number of versions in it.
+func ExportHistory(filePath string, w io.Writer) (int, error) {
+	var count int
+	err := withLocks("", false, func() error {
+		var err error
+		count, err = exportHistory(filePath, w)
+		return err
+	})
+	return count, err
+}
+
+func exportHistory(filePath string, w io.Writer) (int, error) {
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		return 0, err
+	}
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return 0, err
+	}
+	tags, err := ListTags(versionDir)
+	if err != nil {
+		return 0, err
+	}
+	header := bundleHeader{
+		Path:     filePath,
+		Head:     readHead(versionDir),
+		Versions: *versions,
+		Tags:     tags,
+	}
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal bundle header: %w", err)
+	}
+
+	if _, err := w.Write(append(append([]byte{}, bundleMagic...), bundleFormat)); err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(w)
+	if err := writeUvarint(zw, uint64(len(headerData))); err != nil {
+		return 0, err
+	}
+	if _, err := zw.Write(headerData); err != nil {
+		return 0, err
+	}
+
+	written := make(map[string]bool)
+	for _, meta := range *versions {
+		if !meta.IsDir && !written[meta.Checksum] {
+			written[meta.Checksum] = true
+			source, err := openVersion(versionDir, meta.ID)
+			if err != nil {
+				return 0, fmt.Errorf("failed to open version %s: %w", meta.ID, err)
+			}
+			err = writeBundleContent(zw, meta.Checksum, meta.Size, source)
+			source.Close()
+			if err != nil {
+				return 0, err
+			}
+		}
+		for _, entry := range meta.Tree {
+			if entry.Checksum == "" || written[entry.Checksum] {
+				continue
+			}
+			written[entry.Checksum] = true
+			source, err := openManifest(entry.Checksum)
+			if err != nil {
+				return 0, fmt.Errorf("failed to open content of %s: %w", entry.Path, err)
+			}
+			err = writeBundleContent(zw, entry.Checksum, entry.Size, source)
+			source.Close()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return len(*versions), nil
+}
+
+func writeUvarint(w io.Writer, v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.Write(buf[:binary.PutUvarint(buf[:], v)])
+	return err
+}
+
+func writeBundleContent(w io.Writer, checksum string, size int64, source io.Reader) error {
+	if err := writeUvarint(w, uint64(len(checksum))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, checksum); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, uint64(size)); err != nil {
+		return err
+	}
+	copied, err := io.Copy(w, source)
+	if err != nil {
+		return fmt.Errorf("failed to write content %s: %w", checksum, err)
+	}
+	if copied != size {
+		return fmt.Errorf("content %s has %d bytes, expected %d", checksum, copied, size)
+	}
+	return nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// ImportHistory reads a bundle from r and makes it the history of targetPath,
+// or of the path it was exported from when targetPath is empty. The target
+// must not have versions yet. It returns the path and the number of versions.
+func ImportHistory(r io.Reader, targetPath string) (string, int, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(bundleMagic)+1)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic[:len(bundleMagic)]) != string(bundleMagic) {
+		return "", 0, fmt.Errorf("not a godex history bundle")
+	}
+	if magic[len(bundleMagic)] != bundleFormat {
+		return "", 0, fmt.Errorf("unsupported bundle format %d", magic[len(bundleMagic)])
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return "", 0, fmt.Errorf("corrupt bundle: %w", err)
+	}
+	defer zr.Close()
+	content := bufio.NewReader(zr)
+
+	headerData, err := readBundleField(content)
+	if err != nil {
+		return "", 0, err
+	}
+	var header bundleHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return "", 0, fmt.Errorf("failed to parse bundle header: %w", err)
+	}
+	if err := checkBundleHeader(header); err != nil {
+		return "", 0, err
+	}
+	sanitizeBundleAttrs(&header)
+	if targetPath == "" {
+		targetPath = header.Path
+	}
+	versionDir, err := GetVersionPath(targetPath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = withLocks(versionDir, false, func() error {
+		if existing, err := ListAllVersions(versionDir); err == nil && len(*existing) > 0 {
+			return fmt.Errorf("%s already has versions", targetPath)
+		} else if err != nil && !errors.Is(err, errNoVersions) {
+			return err
+		}
+		return importHistory(content, header, versionDir, targetPath)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return targetPath, len(header.Versions), nil
+}
+
+// checkBundleHeader makes sure the IDs, references and paths of a bundle are
+// safe to use as file names before anything is written.
+func checkBundleHeader(header bundleHeader) error {
+	if len(header.Versions) == 0 {
+		return fmt.Errorf("the bundle holds no versions")
+	}
+	ids := make(map[string]bool, len(header.Versions))
+	for _, meta := range header.Versions {
+		if !versionIDPattern.MatchString(meta.ID) {
+			return fmt.Errorf("invalid bundle: invalid version ID %q", meta.ID)
+		}
+		if ids[meta.ID] {
+			return fmt.Errorf("invalid bundle: version %s appears twice", meta.ID)
+		}
+		ids[meta.ID] = true
+	}
+	for _, meta := range header.Versions {
+		for _, parent := range []string{meta.Parent, meta.MergeParent} {
+			if parent != "" && !ids[parent] {
+				return fmt.Errorf("invalid bundle: version %s refers to unknown version %q", meta.ID, parent)
+			}
+		}
+		if err := checkBundleTree(meta); err != nil {
+			return err
+		}
+	}
+	if header.Head != "" && !ids[header.Head] {
+		return fmt.Errorf("invalid bundle: HEAD refers to unknown version %q", header.Head)
+	}
+	for name, id := range header.Tags {
+		if !tagNamePattern.MatchString(name) || versionIDPattern.MatchString(name) {
+			return fmt.Errorf("invalid bundle: invalid tag name %q", name)
+		}
+		if !ids[id] {
+			return fmt.Errorf("invalid bundle: tag %s refers to unknown version %q", name, id)
+		}
+	}
+	return nil
+}
+
+// checkBundleTree makes sure every path of a snapshot stays inside it when it
+// is restored: paths are clean and only ever below directories.
+func checkBundleTree(meta VersionMetaData) error {
+	entries := make(map[string]TreeEntry, len(meta.Tree))
+	for _, entry := range meta.Tree {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) || path.Clean(entry.Path) != entry.Path {
+			return fmt.Errorf("invalid bundle: version %s holds the path %q outside the snapshot", meta.ID, entry.Path)
+		}
+		if _, ok := entries[entry.Path]; ok {
+			return fmt.Errorf("invalid bundle: version %s holds the path %q twice", meta.ID, entry.Path)
+		}
+		entries[entry.Path] = entry
+	}
+	for _, entry := range meta.Tree {
+		for dir := path.Dir(entry.Path); dir != "."; dir = path.Dir(dir) {
+			if parent, ok := entries[dir]; ok && !parent.Mode.IsDir() {
+				return fmt.Errorf("invalid bundle: version %s holds %q below %q, which is not a directory", meta.ID, entry.Path, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// sanitizeBundleAttrs drops what a foreign store should not decide about
+// restored files: owners, extended attributes and the setuid, setgid and
+// sticky bits. Snapshot entries only ever restore their permission bits.
+func sanitizeBundleAttrs(header *bundleHeader) {
+	for i := range header.Versions {
+		meta := &header.Versions[i]
+		if meta.Attrs != nil {
+			attrs := *meta.Attrs
+			attrs.Mode &^= os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+			attrs.UID, attrs.GID = -1, -1
+			attrs.Xattrs = nil
+			meta.Attrs = &attrs
+		}
+	}
+}
+
+func readBundleField(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > 1<<30 {
+		return nil, fmt.Errorf("corrupt bundle: field of %d bytes", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("corrupt bundle: %w", err)
+	}
+	return data, nil
+}
+
+func importHistory(r *bufio.Reader, header bundleHeader, versionDir, targetPath string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	stored := make(map[string]bool)
+	for {
+		checksum, err := readBundleField(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("corrupt bundle: %w", err)
+		}
+
+		// the manifest is only written once the content proved to be intact
+		hasher := sha256.New()
+		body := io.TeeReader(io.LimitReader(r, int64(size)), hasher)
+		chunks, storedSize, err := storeChunks(body, config.Compression)
+		if err != nil {
+			return err
+		}
+		if storedSize != int64(size) {
+			return fmt.Errorf("corrupt bundle: content %s is truncated", checksum)
+		}
+		if hex.EncodeToString(hasher.Sum(nil)) != string(checksum) {
+			return fmt.Errorf("checksum verification failed for content %s: bundle may be corrupted", checksum)
+		}
+		if err := writeManifest(string(checksum), Manifest{Size: storedSize, Chunks: chunks}); err != nil {
+			return err
+		}
+		stored[string(checksum)] = true
+	}
+
+	for _, meta := range header.Versions {
+		if meta.IsDir {
+			if treeChecksum(meta.Tree) != meta.Checksum {
+				return fmt.Errorf("checksum verification failed for snapshot %s", meta.ID)
+			}
+		} else if !stored[meta.Checksum] {
+			return fmt.Errorf("the bundle is missing the content of version %s", meta.ID)
+		}
+		for _, entry := range meta.Tree {
+			if entry.Checksum != "" && !stored[entry.Checksum] {
+				return fmt.Errorf("the bundle is missing the content of %s in version %s", entry.Path, meta.ID)
+			}
+		}
+	}
+
+	// old copies would shadow the imported content
+	for _, meta := range header.Versions {
+		if err := os.Remove(filepath.Join(versionDir, meta.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = withIndex(true, func(tx *bolt.Tx) error {
+		if err := deleteFile(tx, versionDir); err != nil {
+			return err
+		}
+		for _, meta := range header.Versions {
+			if err := appendVersion(tx, versionDir, meta); err != nil {
+				return err
+			}
+		}
+		if err := storeTags(tx, versionDir, header.Tags); err != nil {
+			return err
+		}
+		return recordFile(tx, versionDir, targetPath, header.Versions[len(header.Versions)-1].CreatedAt)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the version index: %w", err)
+	}
+	if header.Head != "" {
+		return writeHead(versionDir, header.Head)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package version
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckBundleHeader(t *testing.T) {
+	file := func(path string) TreeEntry { return TreeEntry{Path: path, Mode: 0644, Checksum: "c"} }
+	dir := func(path string) TreeEntry { return TreeEntry{Path: path, Mode: os.ModeDir | 0755} }
+	link := func(path, target string) TreeEntry {
+		return TreeEntry{Path: path, Mode: os.ModeSymlink | 0777, Target: target}
+	}
+	snapshot := func(tree ...TreeEntry) bundleHeader {
+		return bundleHeader{Versions: []VersionMetaData{{ID: "v1", IsDir: true, Tree: tree}}}
+	}
+
+	tests := []struct {
+		name    string
+		header  bundleHeader
+		wantErr bool
+	}{
+		{name: "files below directories", header: snapshot(dir("d"), file("d/x"), link("l", "/etc"))},
+		{name: "no versions", header: bundleHeader{}, wantErr: true},
+		{name: "invalid ID", header: bundleHeader{Versions: []VersionMetaData{{ID: "../v1"}}}, wantErr: true},
+		{name: "unknown parent", header: bundleHeader{Versions: []VersionMetaData{{ID: "v2", Parent: "v1"}}}, wantErr: true},
+		{name: "unknown HEAD", header: bundleHeader{Head: "v9", Versions: []VersionMetaData{{ID: "v1"}}}, wantErr: true},
+		{name: "absolute path", header: snapshot(file("/etc/passwd")), wantErr: true},
+		{name: "path leaving the snapshot", header: snapshot(file("../x")), wantErr: true},
+		{name: "unclean path", header: snapshot(dir("d"), file("d/../x")), wantErr: true},
+		{name: "path twice", header: snapshot(file("x"), file("x")), wantErr: true},
+		{name: "path below a link", header: snapshot(link("d", "/home/u/.ssh"), file("d/authorized_keys")), wantErr: true},
+		{name: "path deep below a link", header: snapshot(link("d", "/tmp"), dir("d/e"), file("d/e/x")), wantErr: true},
+		{name: "path below a file", header: snapshot(file("d"), file("d/x")), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkBundleHeader(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkBundleHeader = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSanitizeBundleAttrs(t *testing.T) {
+	header := bundleHeader{Versions: []VersionMetaData{
+		{ID: "v1", Attrs: &FileAttrs{
+			Mode:   os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0755,
+			UID:    0,
+			GID:    0,
+			Xattrs: map[string][]byte{"security.capability": {1}},
+		}},
+		{ID: "v2"},
+	}}
+	original := header.Versions[0].Attrs
+
+	sanitizeBundleAttrs(&header)
+	attrs := header.Versions[0].Attrs
+	if attrs.Mode != 0755 {
+		t.Errorf("mode is %v, want %v", attrs.Mode, os.FileMode(0755))
+	}
+	if attrs.UID != -1 || attrs.GID != -1 {
+		t.Errorf("owner is %d:%d, want none", attrs.UID, attrs.GID)
+	}
+	if attrs.Xattrs != nil {
+		t.Errorf("extended attributes %v were kept", attrs.Xattrs)
+	}
+	if original.UID != 0 {
+		t.Errorf("the attributes of the bundle were changed in place")
+	}
+	if header.Versions[1].Attrs != nil {
+		t.Errorf("attributes were made up for a version without them")
+	}
+}
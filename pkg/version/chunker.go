@@ -0,0 +1,65 @@
+package version
+
+import (
+	"bufio"
+	"io"
+)
+
+// Chunk boundaries are content defined (gear rolling hash, FastCDC style) so an
+// insertion near the start of a file only changes the chunks around it and every
+// other chunk is shared with the previous versions.
+const (
+	minChunkSize = 16 * 1024
+	maxChunkSize = 256 * 1024
+	chunkMask    = (1 << 16) - 1 // ~64 KiB average chunk
+)
+
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64 with a fixed seed, the table must never change or existing
+	// chunks stop deduplicating against new ones
+	seed := uint64(0x676f646578)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+type chunker struct {
+	reader *bufio.Reader
+	buf    []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		reader: bufio.NewReaderSize(r, maxChunkSize),
+		buf:    make([]byte, 0, maxChunkSize),
+	}
+}
+
+// Next returns the next chunk of the stream. The returned slice is only valid
+// until the following call. io.EOF is returned once the stream is exhausted.
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+
+	for len(c.buf) < maxChunkSize {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(c.buf) > 0 {
+				return c.buf, nil
+			}
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = (hash << 1) + gearTable[b]
+		if len(c.buf) >= minChunkSize && hash&chunkMask == 0 {
+			return c.buf, nil
+		}
+	}
+	return c.buf, nil
+}
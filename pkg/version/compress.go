@@ -0,0 +1,119 @@
+package version
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunks are stored behind a small header naming the codec their body is
+// compressed with: the magic "GDXZ" followed by one codec byte. Chunks written
+// before compression, and chunks compression did not make smaller, are stored
+// raw. A raw chunk that happens to start with the magic is told apart by its
+// hash, which is always taken over the uncompressed content.
+
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+var chunkMagic = []byte("GDXZ")
+
+var codecIDs = map[string]byte{
+	CodecNone: 0,
+	CodecGzip: 1,
+	CodecZstd: 2,
+}
+
+func validCodec(codec string) bool {
+	_, ok := codecIDs[codec]
+	return ok
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// compressChunk encodes data with codec. It returns data unchanged when the
+// codec is none or compression does not save anything.
+func compressChunk(data []byte, codec string) ([]byte, error) {
+	var body []byte
+	switch codec {
+	case CodecNone, "":
+		return data, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	case CodecZstd:
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		body = encoder.EncodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+
+	if len(body)+len(chunkMagic)+1 >= len(data) {
+		return data, nil
+	}
+	stored := make([]byte, 0, len(chunkMagic)+1+len(body))
+	stored = append(stored, chunkMagic...)
+	stored = append(stored, codecIDs[codec])
+	return append(stored, body...), nil
+}
+
+// decompressChunk decodes a stored chunk. ok is false when stored carries no
+// header, in which case it is the raw content.
+func decompressChunk(stored []byte) (data []byte, ok bool, err error) {
+	if len(stored) <= len(chunkMagic) || !bytes.HasPrefix(stored, chunkMagic) {
+		return stored, false, nil
+	}
+	body := stored[len(chunkMagic)+1:]
+	switch stored[len(chunkMagic)] {
+	case codecIDs[CodecNone]:
+		return body, true, nil
+	case codecIDs[CodecGzip]:
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, true, err
+		}
+		defer reader.Close()
+		data, err = io.ReadAll(reader)
+		return data, true, err
+	case codecIDs[CodecZstd]:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, true, err
+		}
+		data, err = decoder.DecodeAll(body, nil)
+		return data, true, err
+	}
+	return stored, false, nil
+}
@@ -0,0 +1,122 @@
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Settings for the version store live in ~/.config/godex/config.json and apply
+// to every tracked file.
+
+type Config struct {
+	// Compression is the codec new chunks are stored with: zstd, gzip or none.
+	Compression string `json:",omitempty"`
+}
+
+func DefaultConfig() Config {
+	return Config{Compression: CodecZstd}
+}
+
+func configPath() (string, error) {
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(godexDir, "config.json"), nil
+}
+
+// LoadConfig reads the config, with defaults for everything not set.
+func LoadConfig() (Config, error) {
+	config := DefaultConfig()
+	path, err := configPath()
+	if err != nil {
+		return config, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return config, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse config: %w", err)
+	}
+	return config, nil
+}
+
+func SaveConfig(config Config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config to JSON")
+	}
+	if err := writeFileAtomic(path, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// configKeys maps the names used by godex version config to the fields of
+// Config.
+var configKeys = map[string]struct {
+	get func(Config) string
+	set func(*Config, string) error
+}{
+	"compression": {
+		get: func(c Config) string { return c.Compression },
+		set: func(c *Config, value string) error {
+			if !validCodec(value) {
+				return fmt.Errorf("unknown compression %q: use zstd, gzip or none", value)
+			}
+			c.Compression = value
+			return nil
+		},
+	},
+}
+
+func ConfigKeys() []string {
+	keys := make([]string, 0, len(configKeys))
+	for key := range configKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func GetConfigValue(key string) (string, error) {
+	field, ok := configKeys[strings.ToLower(key)]
+	if !ok {
+		return "", fmt.Errorf("unknown config key %q", key)
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return "", err
+	}
+	return field.get(config), nil
+}
+
+func SetConfigValue(key, value string) error {
+	field, ok := configKeys[strings.ToLower(key)]
+	if !ok {
+		return fmt.Errorf("unknown config key %q", key)
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	if err := field.set(&config, value); err != nil {
+		return err
+	}
+	return SaveConfig(config)
+}
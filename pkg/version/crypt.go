@@ -0,0 +1,681 @@
+package version
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encryption is opt-in. Once enabled, chunks, manifests, the version records of
+// the index and legacy vN copies are sealed with AES-256-GCM under a random data key:
+//
+//	"GDXE" key ID (8 bytes) nonce (12 bytes) ciphertext
+//
+// The object name is authenticated along with the content, so blobs cannot be
+// swapped. Chunks, manifests and the reference counts of the index are named
+// by an HMAC of the content hash under a key derived from a data key, so the
+// names cannot be used to confirm guesses of the content. key.json holds the
+// data keys wrapped with a key derived from a passphrase (scrypt) or from a
+// key file. Rotating keys adds a new data key
+// first and drops the old one only after everything was sealed again, so an
+// interrupted rekey leaves a readable store. Files without the header are
+// read as plaintext.
+
+const (
+	KeyKindPassphrase = "passphrase"
+	KeyKindFile       = "keyfile"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var sealMagic = []byte("GDXE")
+
+var ErrStoreLocked = errors.New("the version store is encrypted: set GODEX_PASSPHRASE or GODEX_KEY_FILE")
+
+// PassphraseFunc asks for the passphrase of an encrypted store when
+// GODEX_PASSPHRASE is not set.
+var PassphraseFunc func(prompt string) ([]byte, error)
+
+// KeySource is what the wrapping key is derived from: a passphrase, or the
+// contents of KeyFile when it is set.
+type KeySource struct {
+	Passphrase []byte
+	KeyFile    string
+}
+
+type wrappedKey struct {
+	ID      string
+	Nonce   []byte
+	Wrapped []byte
+}
+
+type keyFile struct {
+	Kind string
+	Salt []byte
+	N    int `json:",omitempty"`
+	R    int `json:",omitempty"`
+	P    int `json:",omitempty"`
+	// Keys[0] seals new content, the others are only used for reading
+	Keys []wrappedKey
+	// NameKey is the ID of the data key objects are named with, empty for
+	// stores that still name them by their hash
+	NameKey string `json:",omitempty"`
+}
+
+type keyring struct {
+	current string
+	keys    map[string][]byte
+	aeads   map[string]cipher.AEAD
+	// names is the key of objectName, nil while objects are named by hash
+	names []byte
+}
+
+var (
+	keyringMu sync.Mutex
+	unlocked  *keyring
+)
+
+func keyFilePath() (string, error) {
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(godexDir, "key.json"), nil
+}
+
+func EncryptionEnabled() (bool, error) {
+	path, err := keyFilePath()
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func readKeyFile() (keyFile, error) {
+	var kf keyFile
+	path, err := keyFilePath()
+	if err != nil {
+		return kf, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return kf, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return kf, fmt.Errorf("failed to parse key file: %w", err)
+	}
+	if len(kf.Keys) == 0 {
+		return kf, fmt.Errorf("key file holds no keys")
+	}
+	return kf, nil
+}
+
+func writeKeyFile(kf keyFile) error {
+	path, err := keyFilePath()
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal key file")
+	}
+	if err := writeFileAtomic(path, jsonData, 0600); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrappingKey derives the key that protects the data keys.
+func (kf keyFile) wrappingKey(source KeySource) ([]byte, error) {
+	switch kf.Kind {
+	case KeyKindFile:
+		if source.KeyFile == "" {
+			return nil, fmt.Errorf("the version store is encrypted with a key file: set GODEX_KEY_FILE")
+		}
+		secret, err := os.ReadFile(source.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("key file %s holds less than 32 bytes", source.KeyFile)
+		}
+		sum := sha256.Sum256(append(append([]byte{}, kf.Salt...), secret...))
+		return sum[:], nil
+	case KeyKindPassphrase:
+		if len(source.Passphrase) == 0 {
+			return nil, ErrStoreLocked
+		}
+		return scrypt.Key(source.Passphrase, kf.Salt, kf.N, kf.R, kf.P, 32)
+	}
+	return nil, fmt.Errorf("unknown key kind %q", kf.Kind)
+}
+
+func newKeyFile(source KeySource) (keyFile, error) {
+	kf := keyFile{Kind: KeyKindPassphrase, Salt: make([]byte, 16)}
+	if source.KeyFile != "" {
+		kf.Kind = KeyKindFile
+	} else {
+		kf.N, kf.R, kf.P = scryptN, scryptR, scryptP
+	}
+	if _, err := rand.Read(kf.Salt); err != nil {
+		return kf, err
+	}
+	return kf, nil
+}
+
+// wrap adds dataKeys to kf, sealed with the key derived from source.
+func (kf *keyFile) wrap(source KeySource, dataKeys map[string][]byte, order []string) error {
+	kek, err := kf.wrappingKey(source)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return err
+	}
+	kf.Keys = nil
+	for _, id := range order {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		kf.Keys = append(kf.Keys, wrappedKey{
+			ID:      id,
+			Nonce:   nonce,
+			Wrapped: aead.Seal(nil, nonce, dataKeys[id], []byte(id)),
+		})
+	}
+	return nil
+}
+
+func (kf keyFile) unwrap(source KeySource) (map[string][]byte, error) {
+	kek, err := kf.wrappingKey(source)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	dataKeys := make(map[string][]byte, len(kf.Keys))
+	for _, key := range kf.Keys {
+		dataKey, err := aead.Open(nil, key.Nonce, key.Wrapped, []byte(key.ID))
+		if err != nil {
+			if kf.Kind == KeyKindFile {
+				return nil, fmt.Errorf("wrong key file")
+			}
+			return nil, fmt.Errorf("wrong passphrase")
+		}
+		dataKeys[key.ID] = dataKey
+	}
+	return dataKeys, nil
+}
+
+func newDataKey() (string, []byte, error) {
+	key := make([]byte, 32)
+	id := make([]byte, 8)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(id), key, nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// environmentKeySource reads the key source of an encrypted store from
+// GODEX_KEY_FILE or GODEX_PASSPHRASE, and asks through PassphraseFunc last.
+func environmentKeySource(kind string) (KeySource, error) {
+	if kind == KeyKindFile {
+		return KeySource{KeyFile: os.Getenv("GODEX_KEY_FILE")}, nil
+	}
+	if passphrase := os.Getenv("GODEX_PASSPHRASE"); passphrase != "" {
+		return KeySource{Passphrase: []byte(passphrase)}, nil
+	}
+	if PassphraseFunc == nil {
+		return KeySource{}, ErrStoreLocked
+	}
+	passphrase, err := PassphraseFunc("Passphrase for the version store: ")
+	if err != nil {
+		return KeySource{}, err
+	}
+	return KeySource{Passphrase: passphrase}, nil
+}
+
+func setKeyring(current string, dataKeys map[string][]byte, nameKey string) error {
+	ring := &keyring{current: current, keys: dataKeys, aeads: make(map[string]cipher.AEAD, len(dataKeys))}
+	for id, key := range dataKeys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		ring.aeads[id] = aead
+	}
+	if nameKey != "" {
+		dataKey, ok := dataKeys[nameKey]
+		if !ok {
+			return fmt.Errorf("objects are named with an unknown key %s", nameKey)
+		}
+		ring.names = deriveNameKey(dataKey)
+	}
+	unlocked = ring
+	return nil
+}
+
+// deriveNameKey returns the key objects are named with when dataKey names
+// them.
+func deriveNameKey(dataKey []byte) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte("godex object names"))
+	return mac.Sum(nil)
+}
+
+// storeKeyring returns the unlocked keys, or nil when the store is not
+// encrypted.
+func storeKeyring() (*keyring, error) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	if unlocked != nil {
+		return unlocked, nil
+	}
+	enabled, err := EncryptionEnabled()
+	if err != nil || !enabled {
+		return nil, err
+	}
+	kf, err := readKeyFile()
+	if err != nil {
+		return nil, err
+	}
+	source, err := environmentKeySource(kf.Kind)
+	if err != nil {
+		return nil, err
+	}
+	dataKeys, err := kf.unwrap(source)
+	if err != nil {
+		return nil, err
+	}
+	if err := setKeyring(kf.Keys[0].ID, dataKeys, kf.NameKey); err != nil {
+		return nil, err
+	}
+	return unlocked, nil
+}
+
+// Unlock asks for the key of an encrypted store up front. Otherwise that
+// happens the first time something encrypted is read or written.
+func Unlock() error {
+	_, err := storeKeyring()
+	return err
+}
+
+func isSealed(data []byte) bool {
+	return len(data) > len(sealMagic)+8 && bytes.HasPrefix(data, sealMagic)
+}
+
+// sealBlob encrypts data stored under name with the current key. It returns
+// data unchanged when the store is not encrypted.
+func sealBlob(name string, data []byte) ([]byte, error) {
+	ring, err := storeKeyring()
+	if err != nil || ring == nil {
+		return data, err
+	}
+	return ring.seal(name, data)
+}
+
+func (ring *keyring) seal(name string, data []byte) ([]byte, error) {
+	aead := ring.aeads[ring.current]
+	id, err := hex.DecodeString(ring.current)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(sealMagic)+len(id)+aead.NonceSize())
+	header = append(header, sealMagic...)
+	header = append(header, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, data, []byte(name)), nil
+}
+
+// openBlob decrypts data stored under name. Data without the header is
+// returned unchanged.
+func openBlob(name string, data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	ring, err := storeKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if ring == nil {
+		return nil, fmt.Errorf("%s is encrypted but the store has no key file", name)
+	}
+	return ring.open(name, data)
+}
+
+func (ring *keyring) open(name string, data []byte) ([]byte, error) {
+	id := hex.EncodeToString(data[len(sealMagic) : len(sealMagic)+8])
+	aead, ok := ring.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%s is encrypted with an unknown key %s", name, id)
+	}
+	rest := data[len(sealMagic)+8:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s: truncated ciphertext", name)
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to decrypt: %w", name, err)
+	}
+	return plain, nil
+}
+
+// metaBlobName is the name files of a version directory are sealed under.
+func metaBlobName(path string) string {
+	return "versions/" + filepath.Base(filepath.Dir(path)) + "/" + filepath.Base(path)
+}
+
+// readMetaFile reads a file of a version directory, decrypting it if needed.
+func readMetaFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openBlob(metaBlobName(path), data)
+}
+
+func writeMetaFile(path string, data []byte) error {
+	sealed, err := sealBlob(metaBlobName(path), data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, sealed, 0644)
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// EnableEncryption creates the key file and encrypts everything already in the
+// store.
+func EnableEncryption(source KeySource) error {
+	enabled, err := EncryptionEnabled()
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return fmt.Errorf("the version store is already encrypted, use rekey to change the key")
+	}
+	id, dataKey, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	return installKeys(source, id, map[string][]byte{id: dataKey}, "")
+}
+
+// Rekey seals the store with a new data key protected by source, and forgets
+// the old keys.
+func Rekey(source KeySource) error {
+	ring, err := storeKeyring()
+	if err != nil {
+		return err
+	}
+	if ring == nil {
+		return fmt.Errorf("the version store is not encrypted")
+	}
+	dataKeys := make(map[string][]byte, len(ring.keys)+1)
+	for id, key := range ring.keys {
+		dataKeys[id] = key
+	}
+	id, dataKey, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	dataKeys[id] = dataKey
+	nameKey, err := currentNameKey()
+	if err != nil {
+		return err
+	}
+	return installKeys(source, id, dataKeys, nameKey)
+}
+
+func currentNameKey() (string, error) {
+	kf, err := readKeyFile()
+	if err != nil {
+		return "", err
+	}
+	return kf.NameKey, nil
+}
+
+// installKeys writes every key in dataKeys with current first, seals and names
+// the store with current and then drops the other keys. nameKey is the key the
+// objects are named with until then.
+func installKeys(source KeySource, current string, dataKeys map[string][]byte, nameKey string) error {
+	kf, err := newKeyFile(source)
+	if err != nil {
+		return err
+	}
+	kf.NameKey = nameKey
+	order := []string{current}
+	for id := range dataKeys {
+		if id != current {
+			order = append(order, id)
+		}
+	}
+	if err := kf.wrap(source, dataKeys, order); err != nil {
+		return err
+	}
+	return withLocks("", true, func() error {
+		return resealWithKeys(kf, source, current, dataKeys)
+	})
+}
+
+func resealWithKeys(kf keyFile, source KeySource, current string, dataKeys map[string][]byte) error {
+	if err := writeKeyFile(kf); err != nil {
+		return err
+	}
+
+	keyringMu.Lock()
+	err := setKeyring(current, dataKeys, kf.NameKey)
+	keyringMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := resealStore(); err != nil {
+		return fmt.Errorf("failed to encrypt the store, run the command again to finish: %w", err)
+	}
+
+	if err := kf.wrap(source, dataKeys, []string{current}); err != nil {
+		return err
+	}
+	kf.NameKey = current
+	return writeKeyFile(kf)
+}
+
+// resealStore seals every blob of the store with the current key and names the
+// objects with it. Objects already named with any of the known keys are found
+// again, so an interrupted run can be repeated.
+func resealStore() error {
+	ring, err := storeKeyring()
+	if err != nil {
+		return err
+	}
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return err
+	}
+
+	reseal := func(name, path string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if isSealed(data) {
+			if bytes.Equal(data[len(sealMagic):len(sealMagic)+8], mustDecodeHex(ring.current)) {
+				return nil
+			}
+			if data, err = ring.open(name, data); err != nil {
+				return err
+			}
+		}
+		sealed, err := ring.seal(name, data)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(path, sealed, 0644)
+	}
+
+	names := deriveNameKey(ring.keys[ring.current])
+	// knownName tells whether name is the name of hash under any of the keys
+	knownName := func(name, hash string) bool {
+		if name == hash {
+			return true
+		}
+		for _, key := range ring.keys {
+			if name == objectNameWith(deriveNameKey(key), hash) {
+				return true
+			}
+		}
+		return false
+	}
+	// rename stores an object found under name as newName, sealed with the
+	// current key
+	rename := func(kind, name, newName string, data []byte) error {
+		newPath, err := storedObjectPath(kind, newName)
+		if err != nil {
+			return err
+		}
+		sealed, err := ring.seal(kind+"/"+newName, data)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(newPath, sealed, 0644); err != nil {
+			return err
+		}
+		oldPath, err := storedObjectPath(kind, name)
+		if err != nil {
+			return err
+		}
+		return os.Remove(oldPath)
+	}
+
+	err = walkObjects(filepath.Join(godexDir, "objects"), func(name, path string) error {
+		hashOf := func(data []byte) string {
+			sum := sha256.Sum256(data)
+			return hex.EncodeToString(sum[:])
+		}
+		data, err := readStoredChunk(name, func(data []byte) bool {
+			return knownName(name, hashOf(data))
+		})
+		hash := hashOf(data)
+		if err != nil || !knownName(name, hash) {
+			return fmt.Errorf("chunk %s is corrupt, run version fsck --repair first", name)
+		}
+		newName := objectNameWith(names, hash)
+		if newName == name {
+			return reseal("objects/"+name, path)
+		}
+		stored, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if isSealed(stored) {
+			if stored, err = ring.open("objects/"+name, stored); err != nil {
+				return err
+			}
+		}
+		return rename("objects", name, newName, stored)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = walkObjects(filepath.Join(godexDir, "manifests"), func(name, path string) error {
+		manifest, err := readStoredManifest(name)
+		if err != nil {
+			return fmt.Errorf("manifest %s is corrupt, run version fsck --repair first: %w", name, err)
+		}
+		newName := objectNameWith(names, manifest.Checksum)
+		if newName == name {
+			return reseal("manifests/"+name, path)
+		}
+		jsonData, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal manifest: %w", err)
+		}
+		return rename("manifests", name, newName, jsonData)
+	})
+	if err != nil {
+		return err
+	}
+
+	keyringMu.Lock()
+	ring.names = names
+	keyringMu.Unlock()
+
+	versionsDir := filepath.Join(godexDir, "versions")
+	dirs, err := os.ReadDir(versionsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(versionsDir, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !versionIDPattern.MatchString(file.Name()) {
+				continue
+			}
+			path := filepath.Join(versionsDir, dir.Name(), file.Name())
+			if err := reseal(metaBlobName(path), path); err != nil {
+				return err
+			}
+		}
+	}
+	if err := resealIndex(ring); err != nil {
+		return err
+	}
+	if err := withIndex(true, rebuildRefs); err != nil {
+		return err
+	}
+	// bbolt does not wipe freed pages, which still hold the old records
+	return compactIndex()
+}
+
+func mustDecodeHex(s string) []byte {
+	data, _ := hex.DecodeString(s)
+	return data
+}
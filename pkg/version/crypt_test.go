@@ -0,0 +1,168 @@
+package version
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// lockStore forgets the unlocked keys, as a new process would.
+func lockStore(t *testing.T) {
+	t.Helper()
+	keyringMu.Lock()
+	unlocked = nil
+	keyringMu.Unlock()
+}
+
+func TestSealOpen(t *testing.T) {
+	t.Cleanup(func() { lockStore(t) })
+	keys := map[string][]byte{
+		"0102030405060708": bytes.Repeat([]byte{1}, 32),
+		"1112131415161718": bytes.Repeat([]byte{2}, 32),
+	}
+	if err := setKeyring("0102030405060708", keys, ""); err != nil {
+		t.Fatal(err)
+	}
+	ring := unlocked
+	sealed, err := ring.seal("objects/ab", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("sealed blob %q is not encrypted", sealed)
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	unknownKey := append([]byte{}, sealed...)
+	copy(unknownKey[len(sealMagic):], "\xff\xff\xff\xff\xff\xff\xff\xff")
+
+	tests := []struct {
+		name    string
+		blob    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "round trip", blob: "objects/ab", data: sealed, want: "secret"},
+		{name: "other name", blob: "objects/cd", data: sealed, wantErr: true},
+		{name: "tampered", blob: "objects/ab", data: tampered, wantErr: true},
+		{name: "unknown key", blob: "objects/ab", data: unknownKey, wantErr: true},
+		{name: "truncated", blob: "objects/ab", data: sealed[:len(sealMagic)+10], wantErr: true},
+		{name: "not sealed", blob: "objects/ab", data: []byte("plain"), want: "plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := openBlob(tt.blob, tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("opened %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// content sealed with an older key stays readable after the current
+	// key changed
+	if err := setKeyring("1112131415161718", keys, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := openBlob("objects/ab", sealed); err != nil || string(got) != "secret" {
+		t.Errorf("openBlob with an older key = %q, %v", got, err)
+	}
+}
+
+func TestEncryptionAndRekey(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Cleanup(func() { lockStore(t) })
+	filePath := filepath.Join(t.TempDir(), "secret.txt")
+	for _, content := range []string{"first secret\n", "second secret\n"} {
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CreateFile(filePath, "", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := FindVersion(versionDir, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainPath, err := storedObjectPath("manifests", first.Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// storedManifest returns the path the content of v1 is stored at now and
+	// checks that it is sealed
+	storedManifest := func() string {
+		t.Helper()
+		path, err := objectPath("manifests", first.Checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isSealed(data) {
+			t.Errorf("manifest %s is not sealed", path)
+		}
+		return path
+	}
+	restored := func() string {
+		t.Helper()
+		if err := RestoreFile(versionDir, "v1", filePath); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	if err := EnableEncryption(KeySource{Passphrase: []byte("one")}); err != nil {
+		t.Fatal(err)
+	}
+	lockStore(t)
+	t.Setenv("GODEX_PASSPHRASE", "one")
+	sealedPath := storedManifest()
+	if sealedPath == plainPath {
+		t.Errorf("the manifest of v1 is still named by its checksum")
+	}
+	if _, err := os.Stat(plainPath); !os.IsNotExist(err) {
+		t.Errorf("the manifest of v1 is still stored under its checksum")
+	}
+	if got := restored(); got != "first secret\n" {
+		t.Errorf("restored %q, want %q", got, "first secret\n")
+	}
+
+	if err := Rekey(KeySource{Passphrase: []byte("two")}); err != nil {
+		t.Fatal(err)
+	}
+	lockStore(t)
+	if err := Unlock(); err == nil {
+		t.Errorf("the old passphrase still unlocks the store")
+	}
+	lockStore(t)
+	t.Setenv("GODEX_PASSPHRASE", "two")
+	if path := storedManifest(); path == sealedPath {
+		t.Errorf("the manifest of v1 kept its name after the rekey")
+	}
+	if got := restored(); got != "first secret\n" {
+		t.Errorf("restored %q after the rekey, want %q", got, "first secret\n")
+	}
+}
@@ -0,0 +1,170 @@
+package version
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A delta rebuilds a target from a base with two instructions: copy a range of
+// the base, or insert literal bytes. Matches are found by indexing the base in
+// fixed blocks and sliding a rolling hash over the target, then growing every
+// match in both directions.
+//
+//	"GDXD" uvarint(base size) uvarint(target size)
+//	'C' uvarint(offset) uvarint(length) | 'I' uvarint(length) bytes ...
+
+const (
+	deltaBlockSize = 32
+	deltaHashBase  = 1099511628211
+)
+
+var deltaMagic = []byte("GDXD")
+
+var errBadDelta = errors.New("malformed delta")
+
+func blockHash(data []byte) uint64 {
+	var h uint64
+	for _, b := range data {
+		h = h*deltaHashBase + uint64(b)
+	}
+	return h
+}
+
+type deltaWriter struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *deltaWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.buf.Write(w.tmp[:n])
+}
+
+func (w *deltaWriter) insert(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	w.buf.WriteByte('I')
+	w.uvarint(uint64(len(data)))
+	w.buf.Write(data)
+}
+
+func (w *deltaWriter) copy(offset, length int) {
+	w.buf.WriteByte('C')
+	w.uvarint(uint64(offset))
+	w.uvarint(uint64(length))
+}
+
+func encodeDelta(base, target []byte) []byte {
+	var w deltaWriter
+	w.buf.Write(deltaMagic)
+	w.uvarint(uint64(len(base)))
+	w.uvarint(uint64(len(target)))
+
+	index := make(map[uint64]int, len(base)/deltaBlockSize)
+	for i := 0; i+deltaBlockSize <= len(base); i += deltaBlockSize {
+		h := blockHash(base[i : i+deltaBlockSize])
+		if _, ok := index[h]; !ok {
+			index[h] = i
+		}
+	}
+
+	// weight of the byte leaving the window
+	var outWeight uint64 = 1
+	for i := 1; i < deltaBlockSize; i++ {
+		outWeight *= deltaHashBase
+	}
+
+	literal := 0
+	position := 0
+	var h uint64
+	if len(target) >= deltaBlockSize {
+		h = blockHash(target[:deltaBlockSize])
+	}
+	for position+deltaBlockSize <= len(target) {
+		offset, ok := index[h]
+		if ok && bytes.Equal(base[offset:offset+deltaBlockSize], target[position:position+deltaBlockSize]) {
+			start, baseStart := position, offset
+			for start > literal && baseStart > 0 && target[start-1] == base[baseStart-1] {
+				start--
+				baseStart--
+			}
+			end, baseEnd := position+deltaBlockSize, offset+deltaBlockSize
+			for end < len(target) && baseEnd < len(base) && target[end] == base[baseEnd] {
+				end++
+				baseEnd++
+			}
+
+			w.insert(target[literal:start])
+			w.copy(baseStart, end-start)
+			literal, position = end, end
+			if position+deltaBlockSize <= len(target) {
+				h = blockHash(target[position : position+deltaBlockSize])
+			}
+			continue
+		}
+
+		if position+deltaBlockSize < len(target) {
+			h = (h-uint64(target[position])*outWeight)*deltaHashBase + uint64(target[position+deltaBlockSize])
+		}
+		position++
+	}
+	w.insert(target[literal:])
+	return w.buf.Bytes()
+}
+
+// applyDelta rebuilds the target of delta from base. The target may not be
+// larger than maxSize, which keeps a corrupt delta from claiming any amount
+// of memory.
+func applyDelta(base, delta []byte, maxSize int64) ([]byte, error) {
+	if !bytes.HasPrefix(delta, deltaMagic) {
+		return nil, errBadDelta
+	}
+	r := bytes.NewReader(delta[len(deltaMagic):])
+	baseSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errBadDelta
+	}
+	targetSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errBadDelta
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("delta expects a base of %d bytes, got %d", baseSize, len(base))
+	}
+	if maxSize < 0 || targetSize > uint64(maxSize) {
+		return nil, fmt.Errorf("delta target of %d bytes exceeds %d", targetSize, maxSize)
+	}
+
+	target := make([]byte, 0, targetSize)
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch op {
+		case 'C':
+			offset, err1 := binary.ReadUvarint(r)
+			length, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil ||
+				length > uint64(len(base)) || offset > uint64(len(base))-length ||
+				length > targetSize-uint64(len(target)) {
+				return nil, errBadDelta
+			}
+			target = append(target, base[offset:offset+length]...)
+		case 'I':
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > uint64(r.Len()) || length > targetSize-uint64(len(target)) {
+				return nil, errBadDelta
+			}
+			start := len(target)
+			target = append(target, make([]byte, length)...)
+			r.Read(target[start:])
+		default:
+			return nil, errBadDelta
+		}
+	}
+	if uint64(len(target)) != targetSize {
+		return nil, errBadDelta
+	}
+	return target, nil
+}
@@ -0,0 +1,87 @@
+package version
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	block := strings.Repeat("0123456789abcdefghijklmnopqrstuv", 8)
+	tests := []struct {
+		name   string
+		base   string
+		target string
+	}{
+		{"both empty", "", ""},
+		{"empty base", "", "new content\n"},
+		{"empty target", block, ""},
+		{"identical", block, block},
+		{"shorter than a block", "abc", "abd"},
+		{"insert in the middle", block + block, block + "inserted\n" + block},
+		{"change at both ends", block, "x" + block[1:len(block)-1] + "y"},
+		{"reordered", block + strings.ToUpper(block), strings.ToUpper(block) + block},
+		{"unrelated", block, strings.Repeat("z", 300)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := encodeDelta([]byte(tt.base), []byte(tt.target))
+			got, err := applyDelta([]byte(tt.base), delta, int64(len(tt.target)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.target {
+				t.Errorf("got %q, want %q", got, tt.target)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaRejectsCorruptInput(t *testing.T) {
+	base := []byte("0123456789")
+	header := func(baseSize, targetSize uint64) []byte {
+		delta := append([]byte{}, deltaMagic...)
+		delta = binary.AppendUvarint(delta, baseSize)
+		return binary.AppendUvarint(delta, targetSize)
+	}
+	copyOp := func(delta []byte, offset, length uint64) []byte {
+		delta = append(delta, 'C')
+		delta = binary.AppendUvarint(delta, offset)
+		return binary.AppendUvarint(delta, length)
+	}
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"no magic", []byte("nope")},
+		{"truncated header", deltaMagic},
+		{"wrong base size", copyOp(header(9, 4), 0, 4)},
+		{"huge target size", header(10, math.MaxUint64)},
+		{"target larger than allowed", copyOp(header(10, 11), 0, 10)},
+		{"copy past the base", copyOp(header(10, 4), 8, 4)},
+		{"copy offset overflows", copyOp(header(10, 4), math.MaxUint64-1, 4)},
+		{"copy length overflows", copyOp(header(10, 4), 4, math.MaxUint64-1)},
+		{"copy past the target size", copyOp(copyOp(header(10, 4), 0, 4), 0, 4)},
+		{"insert past the delta", append(binary.AppendUvarint(append(header(10, 4), 'I'), 100), "abcd"...)},
+		{"short target", copyOp(header(10, 4), 0, 2)},
+		{"unknown instruction", append(header(10, 4), 'X')},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyDelta(base, tt.delta, 10)
+			if err == nil {
+				t.Errorf("applied %q, want an error", got)
+			}
+		})
+	}
+
+	valid := copyOp(header(10, 4), 6, 4)
+	if got, err := applyDelta(base, valid, 10); err != nil || !bytes.Equal(got, []byte("6789")) {
+		t.Errorf("applyDelta = %q, %v, want %q", got, err, "6789")
+	}
+}
@@ -0,0 +1,313 @@
+package version
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+type LineOp int
+
+const (
+	LineEqual LineOp = iota
+	LineDelete
+	LineInsert
+)
+
+type DiffOptions struct {
+	// Context is the number of unchanged lines shown around each change.
+	Context int
+	// Hex keeps the changed bytes of binary files for a hex dump.
+	Hex bool
+	// Semantic compares JSON, YAML or TOML documents by key path. Syntax
+	// forces one of them, otherwise it is detected.
+	Semantic bool
+	Syntax   string
+}
+
+func DefaultDiffOptions() DiffOptions {
+	return DiffOptions{Context: 3}
+}
+
+// splitLines cuts content into lines, each keeping its trailing newline so a
+// missing newline at the end of the file shows up as a change.
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineRune maps a line index to a rune that survives the string conversions
+// done by diffmatchpatch, skipping the surrogate range.
+func lineRune(index int) rune {
+	if index >= 0xD800 {
+		index += 0x800
+	}
+	return rune(index)
+}
+
+type tokenEdit struct {
+	Op    LineOp
+	Token string
+}
+
+// diffTokens runs a Myers diff over sequences of tokens (lines or words). Every
+// distinct token is mapped to a single rune so the character based
+// diffmatchpatch engine can be used on them.
+func diffTokens(oldTokens, newTokens []string) ([]tokenEdit, error) {
+	index := make(map[string]rune)
+	var unique []string
+	encode := func(tokens []string) ([]rune, error) {
+		runes := make([]rune, len(tokens))
+		for i, token := range tokens {
+			r, ok := index[token]
+			if !ok {
+				if len(unique) >= 0x10F800 {
+					return nil, fmt.Errorf("too many distinct tokens to diff")
+				}
+				r = lineRune(len(unique))
+				index[token] = r
+				unique = append(unique, token)
+			}
+			runes[i] = r
+		}
+		return runes, nil
+	}
+
+	oldRunes, err := encode(oldTokens)
+	if err != nil {
+		return nil, err
+	}
+	newRunes, err := encode(newTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenOf := make(map[rune]string, len(unique))
+	for token, r := range index {
+		tokenOf[r] = token
+	}
+
+	dmp := diffmatchpatch.New()
+	dmp.DiffTimeout = 5 * time.Second
+	diffs := dmp.DiffMainRunes(oldRunes, newRunes, false)
+
+	var edits []tokenEdit
+	for _, diff := range diffs {
+		op := LineEqual
+		switch diff.Type {
+		case diffmatchpatch.DiffDelete:
+			op = LineDelete
+		case diffmatchpatch.DiffInsert:
+			op = LineInsert
+		}
+		for _, r := range []rune(diff.Text) {
+			edits = append(edits, tokenEdit{Op: op, Token: tokenOf[r]})
+		}
+	}
+	return edits, nil
+}
+
+func diffLines(oldLines, newLines []string) ([]DiffLine, error) {
+	tokens, err := diffTokens(oldLines, newLines)
+	if err != nil {
+		return nil, err
+	}
+
+	edits := make([]DiffLine, 0, len(tokens))
+	oldLine, newLine := 0, 0
+	for _, token := range tokens {
+		edit := DiffLine{
+			Op:        token.Op,
+			Text:      strings.TrimSuffix(token.Token, "\n"),
+			NoNewline: !strings.HasSuffix(token.Token, "\n"),
+		}
+		switch token.Op {
+		case LineEqual:
+			oldLine++
+			newLine++
+			edit.OldLine = oldLine
+			edit.NewLine = newLine
+		case LineDelete:
+			oldLine++
+			edit.OldLine = oldLine
+		case LineInsert:
+			newLine++
+			edit.NewLine = newLine
+		}
+		edits = append(edits, edit)
+	}
+	return edits, nil
+}
+
+// buildHunks groups the edit script into hunks with context lines around each
+// change. Changes closer than twice the context share one hunk.
+func buildHunks(edits []DiffLine, context int) []DiffHunk {
+	if context < 0 {
+		context = 0
+	}
+
+	// number of old and new lines before each edit
+	oldBefore := make([]int, len(edits)+1)
+	newBefore := make([]int, len(edits)+1)
+	for i, edit := range edits {
+		oldBefore[i+1] = oldBefore[i]
+		newBefore[i+1] = newBefore[i]
+		if edit.Op != LineInsert {
+			oldBefore[i+1]++
+		}
+		if edit.Op != LineDelete {
+			newBefore[i+1]++
+		}
+	}
+
+	var hunks []DiffHunk
+	n := len(edits)
+	i := 0
+	for i < n {
+		for i < n && edits[i].Op == LineEqual {
+			i++
+		}
+		if i == n {
+			break
+		}
+
+		start := max(0, i-context)
+		end := i
+		for end < n {
+			if edits[end].Op != LineEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < n && edits[run].Op == LineEqual {
+				run++
+			}
+			if run == n || run-end > 2*context {
+				end = min(n, end+context)
+				break
+			}
+			end = run
+		}
+
+		hunk := DiffHunk{
+			OldStart: oldBefore[start],
+			OldLines: oldBefore[end] - oldBefore[start],
+			NewStart: newBefore[start],
+			NewLines: newBefore[end] - newBefore[start],
+			Lines:    edits[start:end],
+		}
+		// unified diff counts from 1 unless the side of the hunk is empty
+		if hunk.OldLines > 0 {
+			hunk.OldStart++
+		}
+		if hunk.NewLines > 0 {
+			hunk.NewStart++
+		}
+		hunks = append(hunks, hunk)
+		i = end
+	}
+	return hunks
+}
+
+func diffContent(content1, content2 []byte, opts DiffOptions) (DiffResult, error) {
+	result := DiffResult{
+		Identical: true,
+		DiffLines: []LineDiff{},
+	}
+
+	if string(content1) == string(content2) {
+		result.Message = "Files are identical"
+		return result, nil
+	}
+
+	if isBinary(content1) || isBinary(content2) {
+		return diffBinary(content1, content2, opts), nil
+	}
+
+	edits, err := diffLines(splitLines(string(content1)), splitLines(string(content2)))
+	if err != nil {
+		return result, err
+	}
+
+	insertions, deletions := 0, 0
+	for _, edit := range edits {
+		switch edit.Op {
+		case LineDelete:
+			deletions++
+			result.DiffLines = append(result.DiffLines, LineDiff{
+				LineNumber: edit.OldLine,
+				Line1:      edit.Text,
+			})
+		case LineInsert:
+			insertions++
+			result.DiffLines = append(result.DiffLines, LineDiff{
+				LineNumber: edit.NewLine,
+				Line2:      edit.Text,
+			})
+		}
+	}
+
+	result.Identical = false
+	result.DiffType = "line"
+	result.Hunks = buildHunks(edits, opts.Context)
+	result.Message = fmt.Sprintf("%d insertions(+), %d deletions(-)", insertions, deletions)
+	return result, nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func formatRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// FormatUnifiedDiff renders the hunks of result as a unified diff that patch
+// and git apply accept.
+func FormatUnifiedDiff(result DiffResult) string {
+	if result.DiffType == "semantic" {
+		return renderSemantic(result, RenderOptions{})
+	}
+	if result.DiffType == "binary" || result.DiffType == "archive" {
+		return fmt.Sprintf("Binary files %s and %s differ\n", result.OldName, result.NewName)
+	}
+	if result.Identical || len(result.Hunks) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("--- %s\n", result.OldName))
+	sb.WriteString(fmt.Sprintf("+++ %s\n", result.NewName))
+
+	for _, hunk := range result.Hunks {
+		sb.WriteString(fmt.Sprintf("@@ -%s +%s @@\n",
+			formatRange(hunk.OldStart, hunk.OldLines),
+			formatRange(hunk.NewStart, hunk.NewLines)))
+		for _, line := range hunk.Lines {
+			switch line.Op {
+			case LineEqual:
+				sb.WriteString(" ")
+			case LineDelete:
+				sb.WriteString("-")
+			case LineInsert:
+				sb.WriteString("+")
+			}
+			sb.WriteString(line.Text)
+			sb.WriteString("\n")
+			if line.NoNewline {
+				sb.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
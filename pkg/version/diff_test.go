@@ -0,0 +1,106 @@
+package version
+
+import "testing"
+
+func TestFormatUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     string
+		new     string
+		context int
+		want    string
+	}{
+		{
+			name:    "identical",
+			old:     "a\nb\n",
+			new:     "a\nb\n",
+			context: 3,
+			want:    "",
+		},
+		{
+			name:    "changed line",
+			old:     "a\nb\nc\n",
+			new:     "a\nB\nc\n",
+			context: 3,
+			want:    "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name:    "added to empty file",
+			old:     "",
+			new:     "a\nb\n",
+			context: 3,
+			want:    "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:    "removed everything",
+			old:     "a\n",
+			new:     "",
+			context: 3,
+			want:    "--- old\n+++ new\n@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name:    "missing newline at the end",
+			old:     "a\nb\n",
+			new:     "a\nb",
+			context: 3,
+			want:    "--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			name:    "distant changes get their own hunks",
+			old:     "1\n2\n3\n4\n5\n6\n7\n8\n",
+			new:     "one\n2\n3\n4\n5\n6\n7\neight\n",
+			context: 1,
+			want: "--- old\n+++ new\n@@ -1,2 +1,2 @@\n-1\n+one\n 2\n" +
+				"@@ -7,2 +7,2 @@\n 7\n-8\n+eight\n",
+		},
+		{
+			name:    "close changes share a hunk",
+			old:     "1\n2\n3\n4\n",
+			new:     "one\n2\n3\nfour\n",
+			context: 1,
+			want:    "--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n-4\n+four\n",
+		},
+		{
+			name:    "no context",
+			old:     "a\nb\nc\n",
+			new:     "a\nc\n",
+			context: 0,
+			want:    "--- old\n+++ new\n@@ -2 +1,0 @@\n-b\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := diffContent([]byte(tt.old), []byte(tt.new), DiffOptions{Context: tt.context})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result.OldName, result.NewName = "old", "new"
+			if got := FormatUnifiedDiff(result); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLinesNumbersBothSides(t *testing.T) {
+	edits, err := diffLines(splitLines("a\nb\nc\n"), splitLines("a\nx\nc\nd\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DiffLine{
+		{Op: LineEqual, Text: "a", OldLine: 1, NewLine: 1},
+		{Op: LineDelete, Text: "b", OldLine: 2},
+		{Op: LineInsert, Text: "x", NewLine: 2},
+		{Op: LineEqual, Text: "c", OldLine: 3, NewLine: 3},
+		{Op: LineInsert, Text: "d", NewLine: 4},
+	}
+	if len(edits) != len(want) {
+		t.Fatalf("got %d edits %+v, want %d", len(edits), edits, len(want))
+	}
+	for i := range want {
+		if edits[i] != want[i] {
+			t.Errorf("edit %d = %+v, want %+v", i, edits[i], want[i])
+		}
+	}
+}
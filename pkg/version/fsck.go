@@ -0,0 +1,476 @@
+package version
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Fsck reads everything in the store back and checks it: every chunk against
+// its hash, every manifest against the chunks and bases it needs, and every
+// version against its checksum. It also looks for index entries and files on
+// disk that do not match up. Repairing removes what cannot be read back,
+// takes orphaned full copies back into the history and recounts references.
+
+const (
+	ProblemCorruptChunk    = "corrupt chunk"
+	ProblemCorruptManifest = "corrupt manifest"
+	ProblemBadVersion      = "bad version"
+	ProblemOrphanCopy      = "orphaned copy"
+	ProblemOrphanDir       = "orphaned directory"
+	ProblemUnknownPath     = "unknown path"
+	ProblemDanglingTag     = "dangling tag"
+	ProblemDanglingHead    = "dangling HEAD"
+	ProblemRefCount        = "reference count"
+)
+
+type FsckProblem struct {
+	Kind    string
+	Subject string
+	Detail  string
+}
+
+type FsckReport struct {
+	Files        int
+	Versions     int
+	Manifests    int
+	Chunks       int
+	Unreferenced int
+	Problems     []FsckProblem
+	Repairs      []string
+}
+
+// fsckFile is what the index and the disk say about one version directory.
+type fsckFile struct {
+	name     string
+	path     string
+	versions []VersionMetaData
+	tags     map[string]string
+	indexed  bool
+}
+
+// Fsck checks the store. With repair set the problems found are fixed where
+// possible, holding the store to itself.
+func Fsck(repair bool) (FsckReport, error) {
+	if !repair {
+		return fsck(false)
+	}
+	var report FsckReport
+	err := withLocks("", true, func() error {
+		var err error
+		report, err = fsck(true)
+		return err
+	})
+	return report, err
+}
+
+func fsck(repair bool) (FsckReport, error) {
+	var report FsckReport
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return report, err
+	}
+	problem := func(kind, subject, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, FsckProblem{Kind: kind, Subject: subject, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	// chunks
+	badChunks := make(map[string]bool)
+	err = walkObjects(filepath.Join(godexDir, "objects"), func(name, path string) error {
+		report.Chunks++
+		named := func(data []byte) bool {
+			sum := sha256.Sum256(data)
+			hashName, err := objectName(hex.EncodeToString(sum[:]))
+			return err == nil && hashName == name
+		}
+		data, err := readStoredChunk(name, named)
+		if err == nil && !named(data) {
+			err = fmt.Errorf("content does not match its name")
+		}
+		if err != nil {
+			badChunks[name] = true
+			problem(ProblemCorruptChunk, name, "%v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// manifests
+	manifests := make(map[string]Manifest)
+	err = walkManifests(func(checksum string, manifest Manifest, err error) error {
+		report.Manifests++
+		if err != nil {
+			problem(ProblemCorruptManifest, checksum, "%v", err)
+			return nil
+		}
+		manifests[checksum] = manifest
+		for _, chunk := range append(append([]string{}, manifest.Chunks...), manifest.Delta...) {
+			chunkPath, err := objectPath("objects", chunk)
+			if err != nil {
+				problem(ProblemCorruptManifest, checksum, "%v", err)
+				break
+			}
+			if _, err := os.Stat(chunkPath); err != nil {
+				problem(ProblemCorruptManifest, checksum, "refers to missing chunk %s", chunk)
+			} else if badChunks[filepath.Base(chunkPath)] {
+				problem(ProblemCorruptManifest, checksum, "refers to corrupt chunk %s", chunk)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	for checksum, manifest := range manifests {
+		if _, ok := manifests[manifest.Base]; manifest.Base != "" && !ok {
+			problem(ProblemCorruptManifest, checksum, "delta base %s is missing", manifest.Base)
+		}
+	}
+
+	// the index and the version directories
+	files, err := fsckFiles(godexDir)
+	if err != nil {
+		return report, err
+	}
+	verified := make(map[string]error)
+	badVersions := make(map[string]map[string]bool)
+	orphans := make(map[string][]string)
+	for _, file := range files {
+		versionDir := filepath.Join(godexDir, "versions", file.name)
+		subject := file.path
+		if subject == "" {
+			subject = file.name
+		}
+		if file.indexed {
+			report.Files++
+			if file.path == "" {
+				problem(ProblemUnknownPath, file.name, "history of %d versions without a recorded path", len(file.versions))
+			}
+		}
+
+		known := make(map[string]bool)
+		for _, meta := range file.versions {
+			report.Versions++
+			known[meta.ID] = true
+			if err := verifyVersion(versionDir, meta, verified); err != nil {
+				problem(ProblemBadVersion, subject+" "+meta.ID, "%v", err)
+				if badVersions[file.name] == nil {
+					badVersions[file.name] = make(map[string]bool)
+				}
+				badVersions[file.name][meta.ID] = true
+			}
+		}
+		for name, id := range file.tags {
+			if !known[id] {
+				problem(ProblemDanglingTag, subject, "tag %s points to missing version %s", name, id)
+			}
+		}
+		if data, err := os.ReadFile(filepath.Join(versionDir, "HEAD")); err == nil {
+			if head := strings.TrimSpace(string(data)); !known[head] {
+				problem(ProblemDanglingHead, subject, "HEAD points to missing version %s", head)
+			}
+		}
+
+		entries, err := os.ReadDir(versionDir)
+		if err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+		for _, entry := range entries {
+			if versionIDPattern.MatchString(entry.Name()) && !known[entry.Name()] {
+				orphans[file.name] = append(orphans[file.name], entry.Name())
+				problem(ProblemOrphanCopy, subject, "%s is not part of the history", entry.Name())
+			}
+		}
+		if !file.indexed && len(orphans[file.name]) == 0 {
+			problem(ProblemOrphanDir, file.name, "version directory without a history")
+		}
+	}
+
+	var counted, stored map[string]int64
+	err = withIndex(false, func(tx *bolt.Tx) error {
+		var err error
+		counted, err = countRefs(tx)
+		stored = storedRefs(tx)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	// the recorded counts are kept by object name
+	countedNames := make(map[string]bool, len(counted))
+	for checksum, count := range counted {
+		name, err := objectName(checksum)
+		if err != nil {
+			return report, err
+		}
+		countedNames[name] = true
+		if stored[name] != count {
+			problem(ProblemRefCount, checksum, "recorded %d references, found %d", stored[name], count)
+		}
+	}
+	for name, count := range stored {
+		if !countedNames[name] {
+			problem(ProblemRefCount, name, "recorded %d references, found none", count)
+		}
+	}
+
+	live := make(map[string]bool)
+	for checksum := range counted {
+		for current := checksum; current != "" && !live[current]; current = manifests[current].Base {
+			live[current] = true
+		}
+	}
+	for checksum := range manifests {
+		if !live[checksum] {
+			report.Unreferenced++
+		}
+	}
+
+	if repair {
+		if err := repairStore(&report, files, badVersions, orphans); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// fsckFiles lists every version directory known to the index or present on
+// disk.
+func fsckFiles(godexDir string) ([]fsckFile, error) {
+	byName := make(map[string]*fsckFile)
+	err := withIndex(false, func(tx *bolt.Tx) error {
+		filesBucket := tx.Bucket(bucketFiles)
+		if filesBucket == nil {
+			return nil
+		}
+		return filesBucket.ForEach(func(name, _ []byte) error {
+			bucket := filesBucket.Bucket(name)
+			if bucket == nil {
+				return nil
+			}
+			versions, err := loadVersions(tx, string(name))
+			if err != nil {
+				return fmt.Errorf("failed to read the history of %s: %w", name, err)
+			}
+			tags, err := loadTags(tx, string(name))
+			if err != nil {
+				return err
+			}
+			byName[string(name)] = &fsckFile{
+				name:     string(name),
+				path:     string(bucket.Get(keyPath)),
+				versions: versions,
+				tags:     tags,
+				indexed:  true,
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(godexDir, "versions"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && byName[entry.Name()] == nil {
+			byName[entry.Name()] = &fsckFile{name: entry.Name()}
+		}
+	}
+
+	files := make([]fsckFile, 0, len(byName))
+	for _, file := range byName {
+		files = append(files, *file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path+files[i].name < files[j].path+files[j].name })
+	return files, nil
+}
+
+// verifyVersion reads the content of a version back and checks it. Results
+// are remembered by checksum, content is often shared.
+func verifyVersion(versionDir string, meta VersionMetaData, verified map[string]error) error {
+	check := func(checksum string, open func() (io.ReadCloser, error)) error {
+		key := checksum
+		if !meta.IsDir {
+			// a full copy in the version directory is read instead of the store
+			if _, err := os.Stat(filepath.Join(versionDir, meta.ID)); err == nil {
+				key = filepath.Join(versionDir, meta.ID)
+			}
+		}
+		if err, ok := verified[key]; ok {
+			return err
+		}
+		err := hashMatches(checksum, open)
+		verified[key] = err
+		return err
+	}
+
+	if !meta.IsDir {
+		return check(meta.Checksum, func() (io.ReadCloser, error) {
+			return openVersion(versionDir, meta.ID)
+		})
+	}
+	if treeChecksum(meta.Tree) != meta.Checksum {
+		return fmt.Errorf("the file list does not match the snapshot checksum")
+	}
+	for _, entry := range meta.Tree {
+		if entry.Checksum == "" {
+			continue
+		}
+		err := check(entry.Checksum, func() (io.ReadCloser, error) {
+			return openManifest(entry.Checksum)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Path, err)
+		}
+	}
+	return nil
+}
+
+func hashMatches(checksum string, open func() (io.ReadCloser, error)) error {
+	reader, err := open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != checksum {
+		return fmt.Errorf("content does not match checksum %s", checksum)
+	}
+	return nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func repairStore(report *FsckReport, files []fsckFile, badVersions map[string]map[string]bool, orphans map[string][]string) error {
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return err
+	}
+	repaired := func(format string, args ...interface{}) {
+		report.Repairs = append(report.Repairs, fmt.Sprintf(format, args...))
+	}
+
+	for _, file := range files {
+		versionDir := filepath.Join(godexDir, "versions", file.name)
+		subject := file.path
+		if subject == "" {
+			subject = file.name
+		}
+
+		// full copies nothing refers to are taken back as versions
+		for _, id := range orphans[file.name] {
+			meta, err := recoverCopy(versionDir, id)
+			if err != nil {
+				return err
+			}
+			err = withIndex(true, func(tx *bolt.Tx) error {
+				return appendVersion(tx, versionDir, meta)
+			})
+			if err != nil {
+				return err
+			}
+			repaired("%s: recovered %s from its full copy", subject, id)
+		}
+		if !file.indexed && len(orphans[file.name]) == 0 {
+			if err := os.RemoveAll(versionDir); err != nil {
+				return err
+			}
+			repaired("%s: removed empty version directory", file.name)
+			continue
+		}
+
+		if bad := badVersions[file.name]; len(bad) > 0 {
+			if err := removeVersions(versionDir, bad); err != nil {
+				return err
+			}
+			for id := range bad {
+				repaired("%s: removed unreadable version %s", subject, id)
+			}
+		}
+
+		tags, err := ListTags(versionDir)
+		if err != nil {
+			return err
+		}
+		versions, err := ListAllVersions(versionDir)
+		if err != nil {
+			return err
+		}
+		known := make(map[string]bool)
+		for _, meta := range *versions {
+			known[meta.ID] = true
+		}
+		changed := false
+		for name, id := range tags {
+			if !known[id] {
+				delete(tags, name)
+				changed = true
+				repaired("%s: removed tag %s", subject, name)
+			}
+		}
+		if changed {
+			if err := saveTags(versionDir, tags); err != nil {
+				return err
+			}
+		}
+		if data, err := os.ReadFile(filepath.Join(versionDir, "HEAD")); err == nil {
+			if head := strings.TrimSpace(string(data)); !known[head] {
+				if err := os.Remove(filepath.Join(versionDir, "HEAD")); err != nil {
+					return err
+				}
+				repaired("%s: reset HEAD to the latest version", subject)
+			}
+		}
+	}
+
+	err = withIndex(true, func(tx *bolt.Tx) error {
+		return rebuildRefs(tx)
+	})
+	if err != nil {
+		return err
+	}
+	repaired("recounted references")
+
+	if err := collectGarbage(); err != nil {
+		return fmt.Errorf("failed to clean up unreferenced chunks: %w", err)
+	}
+	repaired("removed unreferenced content")
+	return nil
+}
+
+// recoverCopy describes a full copy left in a version directory as a version.
+func recoverCopy(versionDir, id string) (VersionMetaData, error) {
+	copyPath := filepath.Join(versionDir, id)
+	info, err := os.Stat(copyPath)
+	if err != nil {
+		return VersionMetaData{}, err
+	}
+	data, err := readMetaFile(copyPath)
+	if err != nil {
+		return VersionMetaData{}, err
+	}
+	sum := sha256.Sum256(data)
+	return VersionMetaData{
+		ID:        id,
+		Message:   "recovered by fsck",
+		Size:      int64(len(data)),
+		Checksum:  hex.EncodeToString(sum[:]),
+		CreatedAt: info.ModTime(),
+	}, nil
+}
@@ -0,0 +1,726 @@
+package version
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The history of every tracked file lives in ~/.config/godex/index.db, an
+// embedded bbolt database:
+//
+//	files/<versionDir name>/path      original path of the file
+//	files/<versionDir name>/updated   time of the last new version
+//	files/<versionDir name>/versions/ sequence -> VersionMetaData, in order
+//	files/<versionDir name>/tags/     tag name -> version ID
+//	refs/<object name>                number of versions referring to content
+//
+// Version records are sealed like version.json was when the store is
+// encrypted. Stores from before the database had global.json, version.json
+// and tags.json files, which are imported once and then renamed to *.migrated.
+
+var (
+	bucketFiles    = []byte("files")
+	bucketRefs     = []byte("refs")
+	bucketMeta     = []byte("meta")
+	bucketVersions = []byte("versions")
+	bucketTags     = []byte("tags")
+	keyPath        = []byte("path")
+	keyUpdated     = []byte("updated")
+	keyMigrated    = []byte("migrated")
+)
+
+var errNoVersions = errors.New("No version currently exists of this file")
+
+var (
+	indexMu    sync.Mutex
+	indexDB    *bolt.DB
+	indexUsers int
+)
+
+// openIndex returns the database, shared by everything in this process that
+// uses it at the same time. bbolt locks the file, so other processes wait
+// until it is closed again.
+func openIndex() (*bolt.DB, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if indexDB != nil {
+		indexUsers++
+		return indexDB, nil
+	}
+
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(godexDir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(godexDir, "index.db"), 0644, &bolt.Options{Timeout: time.Minute})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the version index: %w", err)
+	}
+	if err := migrateIndex(db, godexDir); err != nil {
+		db.Close()
+		return nil, err
+	}
+	indexDB = db
+	indexUsers = 1
+	return db, nil
+}
+
+func closeIndex() {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	indexUsers--
+	if indexUsers == 0 && indexDB != nil {
+		indexDB.Close()
+		indexDB = nil
+	}
+}
+
+// withIndex runs fn in a read or a write transaction. fn must not start
+// another one.
+func withIndex(write bool, fn func(tx *bolt.Tx) error) error {
+	db, err := openIndex()
+	if err != nil {
+		return err
+	}
+	defer closeIndex()
+	if write {
+		return db.Update(fn)
+	}
+	return db.View(fn)
+}
+
+func fileKey(versionDir string) []byte {
+	return []byte(filepath.Base(versionDir))
+}
+
+// fileBucket returns the bucket of a tracked file, nil when it has none and
+// create is false.
+func fileBucket(tx *bolt.Tx, versionDir string, create bool) (*bolt.Bucket, error) {
+	if !create {
+		files := tx.Bucket(bucketFiles)
+		if files == nil {
+			return nil, nil
+		}
+		return files.Bucket(fileKey(versionDir)), nil
+	}
+	files, err := tx.CreateBucketIfNotExists(bucketFiles)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := files.CreateBucketIfNotExists(fileKey(versionDir))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bucket.CreateBucketIfNotExists(bucketVersions); err != nil {
+		return nil, err
+	}
+	if _, err := bucket.CreateBucketIfNotExists(bucketTags); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func versionRecordName(versionDir string, key []byte) string {
+	return "index/" + filepath.Base(versionDir) + "/" + hex.EncodeToString(key)
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func decodeVersion(versionDir string, key, value []byte) (VersionMetaData, error) {
+	var meta VersionMetaData
+	data, err := openBlob(versionRecordName(versionDir, key), value)
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("failed to parse version record: %w", err)
+	}
+	return meta, nil
+}
+
+func encodeVersion(versionDir string, key []byte, meta VersionMetaData) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata to JSON")
+	}
+	return sealBlob(versionRecordName(versionDir, key), data)
+}
+
+// loadVersions returns the versions of a file in the order they were created.
+func loadVersions(tx *bolt.Tx, versionDir string) ([]VersionMetaData, error) {
+	bucket, err := fileBucket(tx, versionDir, false)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil {
+		return nil, errNoVersions
+	}
+	var versions []VersionMetaData
+	err = bucket.Bucket(bucketVersions).ForEach(func(key, value []byte) error {
+		meta, err := decodeVersion(versionDir, key, value)
+		if err != nil {
+			return err
+		}
+		versions = append(versions, meta)
+		return nil
+	})
+	return versions, err
+}
+
+// contentRefs lists the stored content a version refers to.
+func contentRefs(meta VersionMetaData) []string {
+	var refs []string
+	if !meta.IsDir && meta.Checksum != "" {
+		refs = append(refs, meta.Checksum)
+	}
+	for _, entry := range meta.Tree {
+		if entry.Checksum != "" {
+			refs = append(refs, entry.Checksum)
+		}
+	}
+	return refs
+}
+
+func adjustRefs(tx *bolt.Tx, meta VersionMetaData, delta int64) error {
+	refs, err := tx.CreateBucketIfNotExists(bucketRefs)
+	if err != nil {
+		return err
+	}
+	for _, checksum := range contentRefs(meta) {
+		name, err := objectName(checksum)
+		if err != nil {
+			return err
+		}
+		var count int64
+		if value := refs.Get([]byte(name)); len(value) == 8 {
+			count = int64(binary.BigEndian.Uint64(value))
+		}
+		count += delta
+		if count <= 0 {
+			if err := refs.Delete([]byte(name)); err != nil {
+				return err
+			}
+			continue
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(count))
+		if err := refs.Put([]byte(name), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendVersion(tx *bolt.Tx, versionDir string, meta VersionMetaData) error {
+	bucket, err := fileBucket(tx, versionDir, true)
+	if err != nil {
+		return err
+	}
+	versions := bucket.Bucket(bucketVersions)
+	seq, err := versions.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := sequenceKey(seq)
+	value, err := encodeVersion(versionDir, key, meta)
+	if err != nil {
+		return err
+	}
+	if err := versions.Put(key, value); err != nil {
+		return err
+	}
+	return adjustRefs(tx, meta, 1)
+}
+
+// updateVersions rewrites the versions of a file: update returns the new
+// record for a version, or false to delete it.
+func updateVersions(tx *bolt.Tx, versionDir string, update func(VersionMetaData) (VersionMetaData, bool)) error {
+	bucket, err := fileBucket(tx, versionDir, false)
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		return errNoVersions
+	}
+	versions := bucket.Bucket(bucketVersions)
+
+	type record struct {
+		key  []byte
+		meta VersionMetaData
+	}
+	var records []record
+	err = versions.ForEach(func(key, value []byte) error {
+		meta, err := decodeVersion(versionDir, key, value)
+		if err != nil {
+			return err
+		}
+		records = append(records, record{key: append([]byte{}, key...), meta: meta})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		updated, keep := update(r.meta)
+		if !keep {
+			if err := versions.Delete(r.key); err != nil {
+				return err
+			}
+			if err := adjustRefs(tx, r.meta, -1); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := encodeVersion(versionDir, r.key, updated)
+		if err != nil {
+			return err
+		}
+		if err := versions.Put(r.key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFile forgets a tracked file with all its versions and tags.
+func deleteFile(tx *bolt.Tx, versionDir string) error {
+	err := updateVersions(tx, versionDir, func(VersionMetaData) (VersionMetaData, bool) {
+		return VersionMetaData{}, false
+	})
+	if errors.Is(err, errNoVersions) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketFiles).DeleteBucket(fileKey(versionDir))
+}
+
+// renameFile moves the history and tags of oldDir to newDir, which must have
+// no versions, and records filePath as its path.
+func renameFile(tx *bolt.Tx, oldDir, newDir, filePath string) error {
+	versions, err := loadVersions(tx, oldDir)
+	if err != nil {
+		return err
+	}
+	tags, err := loadTags(tx, oldDir)
+	if err != nil {
+		return err
+	}
+	var updated time.Time
+	if bucket, _ := fileBucket(tx, oldDir, false); bucket != nil {
+		updated.UnmarshalText(bucket.Get(keyUpdated))
+	}
+
+	if err := deleteFile(tx, newDir); err != nil {
+		return err
+	}
+	for _, meta := range versions {
+		if err := appendVersion(tx, newDir, meta); err != nil {
+			return err
+		}
+	}
+	if err := storeTags(tx, newDir, tags); err != nil {
+		return err
+	}
+	if err := recordFile(tx, newDir, filePath, updated); err != nil {
+		return err
+	}
+	return deleteFile(tx, oldDir)
+}
+
+func loadTags(tx *bolt.Tx, versionDir string) (map[string]string, error) {
+	tags := make(map[string]string)
+	bucket, err := fileBucket(tx, versionDir, false)
+	if err != nil || bucket == nil {
+		return tags, err
+	}
+	err = bucket.Bucket(bucketTags).ForEach(func(name, id []byte) error {
+		tags[string(name)] = string(id)
+		return nil
+	})
+	return tags, err
+}
+
+func storeTags(tx *bolt.Tx, versionDir string, tags map[string]string) error {
+	bucket, err := fileBucket(tx, versionDir, true)
+	if err != nil {
+		return err
+	}
+	if err := bucket.DeleteBucket(bucketTags); err != nil {
+		return err
+	}
+	tagBucket, err := bucket.CreateBucket(bucketTags)
+	if err != nil {
+		return err
+	}
+	for name, id := range tags {
+		if err := tagBucket.Put([]byte(name), []byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordFile(tx *bolt.Tx, versionDir, filePath string, updated time.Time) error {
+	bucket, err := fileBucket(tx, versionDir, true)
+	if err != nil {
+		return err
+	}
+	if err := bucket.Put(keyPath, []byte(filePath)); err != nil {
+		return err
+	}
+	stamp, err := updated.MarshalText()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(keyUpdated, stamp)
+}
+
+// liveContent returns the object name of all content some version refers to.
+func liveContent(tx *bolt.Tx) map[string]bool {
+	live := make(map[string]bool)
+	if refs := tx.Bucket(bucketRefs); refs != nil {
+		refs.ForEach(func(name, _ []byte) error {
+			live[string(name)] = true
+			return nil
+		})
+	}
+	return live
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// TrackedFiles lists every file with versions, in no particular order.
+func TrackedFiles() ([]GlobalIndex, error) {
+	var tracked []GlobalIndex
+	err := withIndex(false, func(tx *bolt.Tx) error {
+		files := tx.Bucket(bucketFiles)
+		if files == nil {
+			return nil
+		}
+		return files.ForEach(func(name, _ []byte) error {
+			bucket := files.Bucket(name)
+			if bucket == nil {
+				return nil
+			}
+			entry := GlobalIndex{OriginalFilePath: string(bucket.Get(keyPath))}
+			entry.LastUpdatedAt.UnmarshalText(bucket.Get(keyUpdated))
+			versionDir := string(name)
+			err := bucket.Bucket(bucketVersions).ForEach(func(key, value []byte) error {
+				meta, err := decodeVersion(versionDir, key, value)
+				if err != nil {
+					return err
+				}
+				entry.Versions = append(entry.Versions, meta.ID)
+				return nil
+			})
+			tracked = append(tracked, entry)
+			return err
+		})
+	})
+	return tracked, err
+}
+
+// countRefs works out the reference count of every checksum from the
+// versions themselves.
+func countRefs(tx *bolt.Tx) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	files := tx.Bucket(bucketFiles)
+	if files == nil {
+		return counts, nil
+	}
+	err := files.ForEach(func(name, _ []byte) error {
+		versions, err := loadVersions(tx, string(name))
+		if err != nil && !errors.Is(err, errNoVersions) {
+			return err
+		}
+		for _, meta := range versions {
+			for _, checksum := range contentRefs(meta) {
+				counts[checksum]++
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// storedRefs returns the reference counts as recorded, by object name.
+func storedRefs(tx *bolt.Tx) map[string]int64 {
+	counts := make(map[string]int64)
+	if refs := tx.Bucket(bucketRefs); refs != nil {
+		refs.ForEach(func(name, value []byte) error {
+			if len(value) == 8 {
+				counts[string(name)] = int64(binary.BigEndian.Uint64(value))
+			}
+			return nil
+		})
+	}
+	return counts
+}
+
+// rebuildRefs replaces the reference counts with ones counted from the
+// versions.
+func rebuildRefs(tx *bolt.Tx) error {
+	counts, err := countRefs(tx)
+	if err != nil {
+		return err
+	}
+	if tx.Bucket(bucketRefs) != nil {
+		if err := tx.DeleteBucket(bucketRefs); err != nil {
+			return err
+		}
+	}
+	refs, err := tx.CreateBucket(bucketRefs)
+	if err != nil {
+		return err
+	}
+	for checksum, count := range counts {
+		name, err := objectName(checksum)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(count))
+		if err := refs.Put([]byte(name), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allHistories returns the versions of every tracked file.
+func allHistories() ([][]VersionMetaData, error) {
+	var histories [][]VersionMetaData
+	err := withIndex(false, func(tx *bolt.Tx) error {
+		files := tx.Bucket(bucketFiles)
+		if files == nil {
+			return nil
+		}
+		return files.ForEach(func(name, _ []byte) error {
+			versions, err := loadVersions(tx, string(name))
+			if err != nil && !errors.Is(err, errNoVersions) {
+				return err
+			}
+			histories = append(histories, versions)
+			return nil
+		})
+	})
+	return histories, err
+}
+
+// resealIndex seals every version record with the current key of ring.
+func resealIndex(ring *keyring) error {
+	return withIndex(true, func(tx *bolt.Tx) error {
+		files := tx.Bucket(bucketFiles)
+		if files == nil {
+			return nil
+		}
+		return files.ForEach(func(name, _ []byte) error {
+			bucket := files.Bucket(name)
+			if bucket == nil {
+				return nil
+			}
+			versions := bucket.Bucket(bucketVersions)
+			sealed := make(map[string][]byte)
+			err := versions.ForEach(func(key, value []byte) error {
+				recordName := versionRecordName(string(name), key)
+				data := value
+				if isSealed(data) {
+					if bytes.Equal(data[len(sealMagic):len(sealMagic)+8], mustDecodeHex(ring.current)) {
+						return nil
+					}
+					var err error
+					if data, err = ring.open(recordName, data); err != nil {
+						return err
+					}
+				}
+				value, err := ring.seal(recordName, data)
+				if err != nil {
+					return err
+				}
+				sealed[string(key)] = value
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for key, value := range sealed {
+				if err := versions.Put([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// compactIndex copies the live data of the index into a new file and replaces
+// the old one with it. Nothing in this process may have the index open.
+func compactIndex() error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if indexDB != nil {
+		return fmt.Errorf("the version index is in use")
+	}
+
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return err
+	}
+	indexPath := filepath.Join(godexDir, "index.db")
+	tmpPath := indexPath + ".tmp"
+	os.Remove(tmpPath)
+
+	src, err := bolt.Open(indexPath, 0644, &bolt.Options{Timeout: time.Minute})
+	if err != nil {
+		return fmt.Errorf("failed to open the version index: %w", err)
+	}
+	defer src.Close()
+	dst, err := bolt.Open(tmpPath, 0644, &bolt.Options{Timeout: time.Minute})
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	if err := bolt.Compact(dst, src, 1<<20); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to compact the version index: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, indexPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(godexDir)
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// migrateIndex imports global.json and the version.json and tags.json files
+// of a store from before the index database.
+func migrateIndex(db *bolt.DB, godexDir string) error {
+	var migrated []string
+	err := db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		if meta.Get(keyMigrated) != nil {
+			return nil
+		}
+
+		paths := make(map[string]GlobalIndex)
+		globalPath := filepath.Join(godexDir, "global.json")
+		if data, err := os.ReadFile(globalPath); err == nil {
+			// the first releases could write a single object instead of a list
+			var indices []GlobalIndex
+			if err := json.Unmarshal(data, &indices); err != nil {
+				var single GlobalIndex
+				if err := json.Unmarshal(data, &single); err == nil {
+					indices = []GlobalIndex{single}
+				}
+			}
+			if indices == nil {
+				fmt.Fprintf(os.Stderr, "warning: not importing %s: it is neither a list nor a single entry\n", globalPath)
+			} else {
+				for _, index := range indices {
+					hash := sha256.Sum256([]byte(index.OriginalFilePath))
+					paths[hex.EncodeToString(hash[:])] = index
+				}
+				migrated = append(migrated, globalPath)
+			}
+		}
+
+		versionsDir := filepath.Join(godexDir, "versions")
+		entries, err := os.ReadDir(versionsDir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read versions directory: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			versionDir := filepath.Join(versionsDir, entry.Name())
+			metaPath := filepath.Join(versionDir, "version.json")
+			data, err := readMetaFile(metaPath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return fmt.Errorf("failed to read %s: %w", metaPath, err)
+			}
+			var versions []VersionMetaData
+			if err := json.Unmarshal(data, &versions); err != nil {
+				var single VersionMetaData
+				if err := json.Unmarshal(data, &single); err != nil {
+					fmt.Fprintf(os.Stderr, "warning: not importing %s: %v\n", metaPath, err)
+					continue
+				}
+				versions = []VersionMetaData{single}
+			}
+			if _, err := fileBucket(tx, versionDir, true); err != nil {
+				return err
+			}
+			for _, meta := range versions {
+				if err := appendVersion(tx, versionDir, meta); err != nil {
+					return err
+				}
+			}
+			if index, ok := paths[entry.Name()]; ok {
+				if err := recordFile(tx, versionDir, index.OriginalFilePath, index.LastUpdatedAt); err != nil {
+					return err
+				}
+			}
+			migrated = append(migrated, metaPath)
+
+			tagsPath := filepath.Join(versionDir, "tags.json")
+			if data, err := os.ReadFile(tagsPath); err == nil {
+				tags := make(map[string]string)
+				if err := json.Unmarshal(data, &tags); err != nil {
+					return fmt.Errorf("failed to parse %s: %w", tagsPath, err)
+				}
+				if err := storeTags(tx, versionDir, tags); err != nil {
+					return err
+				}
+				migrated = append(migrated, tagsPath)
+			}
+		}
+		return meta.Put(keyMigrated, []byte(time.Now().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import the JSON version index: %w", err)
+	}
+
+	// the imported files stay around as a backup, but are never read again
+	for _, path := range migrated {
+		os.Rename(path, path+".migrated")
+	}
+	return nil
+}
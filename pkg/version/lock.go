@@ -0,0 +1,70 @@
+package version
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Writers serialize on advisory file locks, always taken in this order:
+//
+//	~/.config/godex/.lock         the store; shared while adding content,
+//	                              exclusive while garbage collecting or
+//	                              rewriting objects
+//	<versionDir>/.lock            the history, tags, HEAD and policy of a file
+//
+// Readers of content hold the store lock shared, so objects are not collected
+// or rewritten while they are read. Metadata needs no lock to be read, every
+// file is replaced by an atomic rename. index.db is locked by bbolt itself
+// for the length of each transaction.
+
+type fileLock struct {
+	file *os.File
+}
+
+func acquireLock(path string, exclusive bool) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock %s: %w", path, err)
+	}
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) Unlock() error {
+	unlockErr := unlockFile(l.file)
+	closeErr := l.file.Close()
+	if unlockErr != nil {
+		return unlockErr
+	}
+	return closeErr
+}
+
+// withLocks runs fn holding the store lock and, when versionDir is set, the
+// lock of that version directory.
+func withLocks(versionDir string, exclusiveStore bool, fn func() error) error {
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return err
+	}
+	storeLock, err := acquireLock(filepath.Join(godexDir, ".lock"), exclusiveStore)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+
+	if versionDir != "" {
+		dirLock, err := acquireLock(filepath.Join(versionDir, ".lock"), true)
+		if err != nil {
+			return err
+		}
+		defer dirLock.Unlock()
+	}
+	return fn()
+}
@@ -0,0 +1,137 @@
+package version
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Creates of the same file from several writers at once must each end up in
+// the history.
+func TestParallelCreatesKeepEveryVersion(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	filePath := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(filePath, []byte("first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+	ids := make([]string, writers)
+	errs := make([]error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// another writer may version this content before we do, which
+			// leaves nothing new for us, so write something else and retry
+			for attempt := 0; ; attempt++ {
+				content := fmt.Sprintf("writer %d attempt %d\n", i, attempt)
+				if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+					errs[i] = err
+					return
+				}
+				meta, err := CreateFile(filePath, "", content)
+				if errors.Is(err, errVersionExists) {
+					continue
+				}
+				ids[i], errs[i] = meta.ID, err
+				return
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	created := make(map[string]bool)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("writer %d: %v", i, err)
+		}
+		if created[ids[i]] {
+			t.Fatalf("version %s was returned to two writers", ids[i])
+		}
+		created[ids[i]] = true
+	}
+
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed := make(map[string]bool)
+	for _, meta := range *versions {
+		if indexed[meta.ID] {
+			t.Fatalf("version %s is in the index twice", meta.ID)
+		}
+		indexed[meta.ID] = true
+	}
+	if len(indexed) != writers {
+		t.Fatalf("index holds %d versions, want %d", len(indexed), writers)
+	}
+	for id := range created {
+		if !indexed[id] {
+			t.Errorf("version %s was created but is missing from the index", id)
+		}
+	}
+	if head := readHead(versionDir); !indexed[head] {
+		t.Errorf("HEAD is %q, not one of the created versions", head)
+	}
+}
+
+// Objects may not be collected or rewritten while a version is being read.
+func TestRepackWaitsForReaders(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	filePath := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(filePath, []byte("content\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFile(filePath, "", "first"); err != nil {
+		t.Fatal(err)
+	}
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the read stays in progress until the pipe is drained
+	pr, pw := io.Pipe()
+	readDone := make(chan error, 1)
+	go func() {
+		err := WriteVersion(versionDir, "v1", "", pw)
+		pw.CloseWithError(err)
+		readDone <- err
+	}()
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(pr, first); err != nil {
+		t.Fatal(err)
+	}
+
+	repackDone := make(chan error, 1)
+	go func() {
+		_, err := Repack(1)
+		repackDone <- err
+	}()
+	select {
+	case err := <-repackDone:
+		t.Fatalf("repack finished during a read: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := io.Copy(io.Discard, pr); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-readDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-repackDone; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,328 @@
+package version
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrMergeConflict is returned by MergeFile when conflict markers were written
+// to the working copy.
+var ErrMergeConflict = errors.New("merge conflict")
+
+// The HEAD file of a version directory holds the version the working copy is
+// based on: the last one created or restored.
+
+func readHead(versionDir string) string {
+	data, err := os.ReadFile(filepath.Join(versionDir, "HEAD"))
+	if err == nil {
+		head := strings.TrimSpace(string(data))
+		if _, err := FindVersion(versionDir, head); err == nil {
+			return head
+		}
+	}
+
+	// histories from before HEAD was tracked follow the latest version
+	versions, err := ListAllVersions(versionDir)
+	if err != nil || len(*versions) == 0 {
+		return ""
+	}
+	return (*versions)[len(*versions)-1].ID
+}
+
+func writeHead(versionDir, versionID string) error {
+	headPath := filepath.Join(versionDir, "HEAD")
+	if err := writeFileAtomic(headPath, []byte(versionID+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to update HEAD: %w", err)
+	}
+	return nil
+}
+
+// MERGE_HEAD holds the version merged into the working copy since the last
+// version was created. The next version records it as its MergeParent.
+
+func readMergeHead(versionDir string) string {
+	data, err := os.ReadFile(filepath.Join(versionDir, "MERGE_HEAD"))
+	if err != nil {
+		return ""
+	}
+	id := strings.TrimSpace(string(data))
+	if _, err := FindVersion(versionDir, id); err != nil {
+		return ""
+	}
+	return id
+}
+
+func writeMergeHead(versionDir, versionID string) error {
+	mergeHeadPath := filepath.Join(versionDir, "MERGE_HEAD")
+	if err := writeFileAtomic(mergeHeadPath, []byte(versionID+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to update MERGE_HEAD: %w", err)
+	}
+	return nil
+}
+
+func clearMergeHead(versionDir string) error {
+	err := os.Remove(filepath.Join(versionDir, "MERGE_HEAD"))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove MERGE_HEAD: %w", err)
+	}
+	return nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// MergeFile merges versionID into the working copy at workingPath, using the
+// common ancestor of versionID and the version the working copy is based on.
+// Conflicting regions are written with conflict markers and ErrMergeConflict
+// is returned together with the result.
+func MergeFile(versionDir, versionID, workingPath string) (MergeResult, error) {
+	var result MergeResult
+	err := withLocks(versionDir, false, func() error {
+		var err error
+		result, err = mergeFile(versionDir, versionID, workingPath)
+		return err
+	})
+	return result, err
+}
+
+func mergeFile(versionDir, versionID, workingPath string) (MergeResult, error) {
+	result := MergeResult{Theirs: versionID}
+
+	theirsMeta, err := FindVersion(versionDir, versionID)
+	if err != nil {
+		return result, err
+	}
+	if theirsMeta.IsDir {
+		return result, fmt.Errorf("version %s is a directory snapshot, only files can be merged", versionID)
+	}
+
+	head := readHead(versionDir)
+	if head == "" {
+		return result, fmt.Errorf("No version currently exists of this file")
+	}
+	result.Head = head
+
+	// a merge not recorded in a version yet is part of the working copy too
+	ours := []string{head}
+	if mergeHead := readMergeHead(versionDir); mergeHead != "" {
+		ours = append(ours, mergeHead)
+	}
+	base, err := mergeBase(versionDir, ours, versionID)
+	if err != nil {
+		return result, err
+	}
+	result.Base = base
+	if base == versionID {
+		result.UpToDate = true
+		return result, nil
+	}
+
+	baseContent, err := readContent(filepath.Join(versionDir, base))
+	if err != nil {
+		return result, fmt.Errorf("failed to read base version %s: %w", base, err)
+	}
+	theirsContent, err := readContent(filepath.Join(versionDir, versionID))
+	if err != nil {
+		return result, fmt.Errorf("failed to read version %s: %w", versionID, err)
+	}
+	oursContent, err := os.ReadFile(workingPath)
+	if err != nil {
+		return result, fmt.Errorf("failed to read working copy: %w", err)
+	}
+
+	if isBinary(baseContent) || isBinary(theirsContent) || isBinary(oursContent) {
+		return result, fmt.Errorf("cannot merge binary content")
+	}
+
+	merged, conflicts, err := mergeContent(
+		splitLines(string(baseContent)),
+		splitLines(string(oursContent)),
+		splitLines(string(theirsContent)),
+		"working copy",
+		versionID,
+	)
+	if err != nil {
+		return result, err
+	}
+	result.Conflicts = conflicts
+
+	info, err := os.Stat(workingPath)
+	if err != nil {
+		return result, err
+	}
+	if err := writeFileAtomic(workingPath, []byte(merged), info.Mode().Perm()); err != nil {
+		return result, fmt.Errorf("failed to write merged file: %w", err)
+	}
+
+	// the working copy stays based on HEAD and now contains versionID as well,
+	// the next version gets both as parents
+	if err := writeMergeHead(versionDir, versionID); err != nil {
+		return result, err
+	}
+
+	if conflicts > 0 {
+		return result, ErrMergeConflict
+	}
+	return result, nil
+}
+
+// editRegion replaces base[start:end] with lines.
+type editRegion struct {
+	start int
+	end   int
+	lines []string
+}
+
+func editRegions(base, changed []string) ([]editRegion, error) {
+	edits, err := diffTokens(base, changed)
+	if err != nil {
+		return nil, err
+	}
+
+	var regions []editRegion
+	var current *editRegion
+	position := 0
+	for _, edit := range edits {
+		if edit.Op == LineEqual {
+			if current != nil {
+				regions = append(regions, *current)
+				current = nil
+			}
+			position++
+			continue
+		}
+		if current == nil {
+			current = &editRegion{start: position, end: position}
+		}
+		if edit.Op == LineDelete {
+			position++
+			current.end = position
+		} else {
+			current.lines = append(current.lines, edit.Token)
+		}
+	}
+	if current != nil {
+		regions = append(regions, *current)
+	}
+	return regions, nil
+}
+
+// applyRegions rebuilds base[start:end] with the given regions applied.
+func applyRegions(base []string, start, end int, regions []editRegion) []string {
+	var lines []string
+	position := start
+	for _, region := range regions {
+		lines = append(lines, base[position:region.start]...)
+		lines = append(lines, region.lines...)
+		position = region.end
+	}
+	return append(lines, base[position:end]...)
+}
+
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeContent is a diff3 style merge. Changes of both sides that overlap or
+// touch the same base lines are grouped; a group changed on one side only, or
+// changed identically on both, merges cleanly, anything else is a conflict.
+func mergeContent(base, ours, theirs []string, oursLabel, theirsLabel string) (string, int, error) {
+	oursRegions, err := editRegions(base, ours)
+	if err != nil {
+		return "", 0, err
+	}
+	theirsRegions, err := editRegions(base, theirs)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var sb strings.Builder
+	conflicts := 0
+	position := 0
+	i, j := 0, 0
+
+	for i < len(oursRegions) || j < len(theirsRegions) {
+		// start the group with whichever change comes first
+		var start, end int
+		if j >= len(theirsRegions) || (i < len(oursRegions) && oursRegions[i].start <= theirsRegions[j].start) {
+			start, end = oursRegions[i].start, oursRegions[i].end
+		} else {
+			start, end = theirsRegions[j].start, theirsRegions[j].end
+		}
+
+		groupOurs, groupTheirs := i, j
+		for {
+			grown := false
+			for i < len(oursRegions) && oursRegions[i].start <= end {
+				end = max(end, oursRegions[i].end)
+				i++
+				grown = true
+			}
+			for j < len(theirsRegions) && theirsRegions[j].start <= end {
+				end = max(end, theirsRegions[j].end)
+				j++
+				grown = true
+			}
+			if !grown {
+				break
+			}
+		}
+
+		for _, line := range base[position:start] {
+			sb.WriteString(line)
+		}
+		position = end
+
+		oursLines := applyRegions(base, start, end, oursRegions[groupOurs:i])
+		theirsLines := applyRegions(base, start, end, theirsRegions[groupTheirs:j])
+
+		switch {
+		case groupTheirs == j:
+			writeLines(&sb, oursLines)
+		case groupOurs == i:
+			writeLines(&sb, theirsLines)
+		case sameLines(oursLines, theirsLines):
+			writeLines(&sb, oursLines)
+		default:
+			conflicts++
+			sb.WriteString("<<<<<<< " + oursLabel + "\n")
+			writeConflictSide(&sb, oursLines)
+			sb.WriteString("=======\n")
+			writeConflictSide(&sb, theirsLines)
+			sb.WriteString(">>>>>>> " + theirsLabel + "\n")
+		}
+	}
+
+	for _, line := range base[position:] {
+		sb.WriteString(line)
+	}
+	return sb.String(), conflicts, nil
+}
+
+func writeLines(sb *strings.Builder, lines []string) {
+	for _, line := range lines {
+		sb.WriteString(line)
+	}
+}
+
+// writeConflictSide makes sure the marker after a side starts on its own line
+// even when the side ends without a newline.
+func writeConflictSide(sb *strings.Builder, lines []string) {
+	for _, line := range lines {
+		sb.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+}
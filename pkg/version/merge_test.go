@@ -0,0 +1,161 @@
+package version
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeContent(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		ours      string
+		theirs    string
+		want      string
+		conflicts int
+	}{
+		{
+			name:   "changes in different places",
+			base:   "a\nb\nc\nd\ne\n",
+			ours:   "A\nb\nc\nd\ne\n",
+			theirs: "a\nb\nc\nd\nE\n",
+			want:   "A\nb\nc\nd\nE\n",
+		},
+		{
+			name:   "only theirs changed",
+			base:   "a\nb\n",
+			ours:   "a\nb\n",
+			theirs: "a\nb\nc\n",
+			want:   "a\nb\nc\n",
+		},
+		{
+			name:   "the same change on both sides",
+			base:   "a\nb\nc\n",
+			ours:   "a\nB\nc\n",
+			theirs: "a\nB\nc\n",
+			want:   "a\nB\nc\n",
+		},
+		{
+			name:   "both sides remove the same line",
+			base:   "a\nb\nc\n",
+			ours:   "a\nc\n",
+			theirs: "a\nc\n",
+			want:   "a\nc\n",
+		},
+		{
+			name:      "conflicting change",
+			base:      "a\nb\nc\n",
+			ours:      "a\nours\nc\n",
+			theirs:    "a\ntheirs\nc\n",
+			want:      "a\n<<<<<<< working copy\nours\n=======\ntheirs\n>>>>>>> v2\nc\n",
+			conflicts: 1,
+		},
+		{
+			name:      "conflict without a newline at the end",
+			base:      "a\nb",
+			ours:      "a\nours",
+			theirs:    "a\ntheirs",
+			want:      "a\n<<<<<<< working copy\nours\n=======\ntheirs\n>>>>>>> v2\n",
+			conflicts: 1,
+		},
+		{
+			name:      "adjacent changes conflict",
+			base:      "a\nb\nc\n",
+			ours:      "A\nb\nc\n",
+			theirs:    "a\nB\nc\n",
+			want:      "<<<<<<< working copy\nA\nb\n=======\na\nB\n>>>>>>> v2\nc\n",
+			conflicts: 1,
+		},
+		{
+			name:      "one conflict and one clean change",
+			base:      "1\n2\n3\n4\n5\n6\n",
+			ours:      "one\n2\n3\n4\n5\n6\n",
+			theirs:    "uno\n2\n3\n4\n5\nsix\n",
+			want:      "<<<<<<< working copy\none\n=======\nuno\n>>>>>>> v2\n2\n3\n4\n5\nsix\n",
+			conflicts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts, err := mergeContent(splitLines(tt.base), splitLines(tt.ours), splitLines(tt.theirs), "working copy", "v2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if conflicts != tt.conflicts {
+				t.Errorf("got %d conflicts, want %d", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
+
+// A merge leaves HEAD on the version the working copy is based on and the
+// next version records the merged one as its second parent.
+func TestMergeFileRecordsSecondParent(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	filePath := filepath.Join(t.TempDir(), "m.txt")
+	writeAndCreate := func(content string) VersionMetaData {
+		t.Helper()
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := CreateFile(filePath, "", content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	writeAndCreate("a\nb\nc\n")
+	theirs := writeAndCreate("a\nb\nC\n")
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreFile(versionDir, "v1", filePath); err != nil {
+		t.Fatal(err)
+	}
+	ours := writeAndCreate("A\nb\nc\n")
+
+	result, err := MergeFile(versionDir, theirs.ID, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Base != "v1" || result.Conflicts != 0 {
+		t.Errorf("merge = %+v, want base v1 without conflicts", result)
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "A\nb\nC\n" {
+		t.Errorf("merged %q, want %q", content, "A\nb\nC\n")
+	}
+	if head := readHead(versionDir); head != ours.ID {
+		t.Errorf("HEAD is %s after the merge, want %s", head, ours.ID)
+	}
+
+	merged, err := CreateFile(filePath, "", "merged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Parent != ours.ID || merged.MergeParent != theirs.ID {
+		t.Errorf("parents are %q and %q, want %q and %q", merged.Parent, merged.MergeParent, ours.ID, theirs.ID)
+	}
+	if mergeHead := readMergeHead(versionDir); mergeHead != "" {
+		t.Errorf("MERGE_HEAD is still %s", mergeHead)
+	}
+
+	// everything of theirs is part of the working copy now
+	again, err := MergeFile(versionDir, theirs.ID, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.UpToDate {
+		t.Errorf("merging %s again is not up to date", theirs.ID)
+	}
+}
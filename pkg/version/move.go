@@ -0,0 +1,170 @@
+package version
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Histories are keyed by the path of a file, so moving the file leaves its
+// history behind. MoveFile re-keys a history to the new path, and FindMovedFrom
+// spots a move after the fact by the content of the new path.
+
+// MoveFile moves the history of oldPath to newPath. When oldPath still exists
+// it is renamed to newPath as well, otherwise only the history follows a move
+// that already happened.
+func MoveFile(oldPath, newPath string) error {
+	if oldPath == newPath {
+		return fmt.Errorf("%s and %s are the same path", oldPath, newPath)
+	}
+	oldDir, err := GetVersionPath(oldPath)
+	if err != nil {
+		return err
+	}
+	newDir, err := GetVersionPath(newPath)
+	if err != nil {
+		return err
+	}
+
+	// the exclusive store lock keeps every other writer out of both directories
+	return withLocks("", true, func() error {
+		versions, err := ListAllVersions(oldDir)
+		if err != nil || len(*versions) == 0 {
+			return fmt.Errorf("%s has no versions", oldPath)
+		}
+		if existing, err := ListAllVersions(newDir); err == nil && len(*existing) > 0 {
+			return fmt.Errorf("%s already has versions", newPath)
+		}
+
+		if _, err := os.Lstat(oldPath); err == nil {
+			if _, err := os.Lstat(newPath); err == nil {
+				return fmt.Errorf("%s already exists", newPath)
+			}
+			if err := os.Rename(oldPath, newPath); err != nil {
+				return fmt.Errorf("failed to move %s: %w", oldPath, err)
+			}
+		}
+		return moveHistory(oldDir, newDir, newPath)
+	})
+}
+
+// moveHistory copies the files of oldDir first, so an interrupted move leaves
+// the history at the old path.
+func moveHistory(oldDir, newDir, newPath string) error {
+	entries, err := os.ReadDir(oldDir)
+	if err != nil {
+		return fmt.Errorf("error reading directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == ".lock" {
+			continue
+		}
+		source := filepath.Join(oldDir, entry.Name())
+		destination := filepath.Join(newDir, entry.Name())
+		var data []byte
+		if versionIDPattern.MatchString(entry.Name()) {
+			// legacy copies are sealed under the name of their directory
+			if data, err = readMetaFile(source); err == nil {
+				err = writeMetaFile(destination, data)
+			}
+		} else if data, err = os.ReadFile(source); err == nil {
+			err = writeFileAtomic(destination, data, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to move %s: %w", entry.Name(), err)
+		}
+	}
+
+	err = withIndex(true, func(tx *bolt.Tx) error {
+		return renameFile(tx, oldDir, newDir, newPath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the version index: %w", err)
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		return fmt.Errorf("history moved but %s could not be removed: %w", oldDir, err)
+	}
+	return nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// FindMovedFrom looks for a tracked file that no longer exists and whose
+// latest or HEAD version has the content newPath has now, which is what a move
+// looks like. It returns "" when newPath has its own history or nothing matches;
+// with several matches the most recently updated one wins.
+func FindMovedFrom(newPath string) (string, error) {
+	info, err := os.Stat(newPath)
+	if err != nil {
+		return "", err
+	}
+	newDir, err := GetVersionPath(newPath)
+	if err != nil {
+		return "", err
+	}
+	if existing, err := ListAllVersions(newDir); err == nil && len(*existing) > 0 {
+		return "", nil
+	} else if err != nil && !errors.Is(err, errNoVersions) {
+		return "", err
+	}
+
+	tracked, err := TrackedFiles()
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(tracked, func(i, j int) bool { return tracked[i].LastUpdatedAt.After(tracked[j].LastUpdatedAt) })
+
+	checksum := ""
+	for _, index := range tracked {
+		if index.OriginalFilePath == "" || index.OriginalFilePath == newPath || len(index.Versions) == 0 {
+			continue
+		}
+		if _, err := os.Lstat(index.OriginalFilePath); !os.IsNotExist(err) {
+			continue
+		}
+		versionDir, err := GetVersionPath(index.OriginalFilePath)
+		if err != nil {
+			return "", err
+		}
+		versions, err := ListAllVersions(versionDir)
+		if err != nil || len(*versions) == 0 {
+			continue
+		}
+		candidates := []VersionMetaData{(*versions)[len(*versions)-1]}
+		if head, err := FindVersion(versionDir, readHead(versionDir)); err == nil {
+			candidates = append(candidates, head)
+		}
+		for _, meta := range candidates {
+			if meta.IsDir != info.IsDir() || (!meta.IsDir && meta.Size != info.Size()) {
+				continue
+			}
+			if checksum == "" {
+				if checksum, err = pathChecksum(newPath, info.IsDir()); err != nil {
+					return "", err
+				}
+			}
+			if meta.Checksum == checksum {
+				return index.OriginalFilePath, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// pathChecksum is the checksum a version of path would get.
+func pathChecksum(path string, isDir bool) (string, error) {
+	if isDir {
+		tree, _, err := scanTree(path, false)
+		if err != nil {
+			return "", err
+		}
+		return treeChecksum(tree), nil
+	}
+	checksum, _, err := hashTreeFile(path, false)
+	return checksum, err
+}
@@ -0,0 +1,581 @@
+package version
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Version content lives in a content addressed store shared by every tracked
+// file. Files are split into chunks stored under objects/ by their SHA-256 and
+// a manifest keyed by the checksum of the whole file (VersionMetaData.Checksum)
+// lists the chunks needed to rebuild it. In an encrypted store the file names
+// are an HMAC of the hash instead, see objectName. Chunks are compressed with the codec
+// set in the config, see compress.go, and older content may be kept as a delta
+// against newer content, see repack.go.
+
+func getGodexDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".config", "godex"), nil
+}
+
+// objectName returns the file name of the content with the given hash. It is
+// the hash itself, or an HMAC of it when the store is encrypted, so the names
+// do not tell which content the store holds.
+func objectName(hash string) (string, error) {
+	ring, err := storeKeyring()
+	if err != nil {
+		return "", err
+	}
+	if ring == nil || ring.names == nil {
+		return hash, nil
+	}
+	return objectNameWith(ring.names, hash), nil
+}
+
+func objectNameWith(key []byte, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func objectPath(kind, hash string) (string, error) {
+	if len(hash) < 3 {
+		return "", fmt.Errorf("invalid object hash %q", hash)
+	}
+	name, err := objectName(hash)
+	if err != nil {
+		return "", err
+	}
+	return storedObjectPath(kind, name)
+}
+
+// storedObjectPath returns the path of the object stored under name.
+func storedObjectPath(kind, name string) (string, error) {
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(godexDir, kind, name[:2], name), nil
+}
+
+// writeFileAtomic writes data next to path and renames it into place so readers
+// never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename in path durable. Not every platform can sync a
+// directory, so failing to is not an error.
+func syncDir(path string) error {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func writeChunk(data []byte, codec string) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	chunkPath, err := objectPath("objects", hash)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(chunkPath); err == nil {
+		return hash, nil
+	}
+	stored, err := compressChunk(data, codec)
+	if err != nil {
+		return "", fmt.Errorf("failed to compress chunk %s: %w", hash, err)
+	}
+	if stored, err = sealBlob("objects/"+filepath.Base(chunkPath), stored); err != nil {
+		return "", fmt.Errorf("failed to encrypt chunk %s: %w", hash, err)
+	}
+	if err := writeFileAtomic(chunkPath, stored, 0644); err != nil {
+		return "", fmt.Errorf("failed to write chunk %s: %w", hash, err)
+	}
+	return hash, nil
+}
+
+func readChunk(hash string) ([]byte, error) {
+	name, err := objectName(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readStoredChunk(name, func(data []byte) bool {
+		return chunkMatches(data, hash)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", hash, err)
+	}
+	return data, nil
+}
+
+// readStoredChunk reads the chunk stored under name. matches tells whether
+// data is the content of the chunk, which tells raw chunks apart from ones
+// with a codec header.
+func readStoredChunk(name string, matches func(data []byte) bool) ([]byte, error) {
+	chunkPath, err := storedObjectPath("objects", name)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := os.ReadFile(chunkPath)
+	if err != nil {
+		return nil, fmt.Errorf("missing chunk: %w", err)
+	}
+	if opened, err := openBlob("objects/"+name, stored); err == nil {
+		stored = opened
+	} else if !matches(stored) {
+		return nil, err
+	}
+	data, compressed, err := decompressChunk(stored)
+	if compressed && (err != nil || !matches(data)) {
+		// a raw chunk that merely looks like it has a header
+		data, err = stored, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	return data, nil
+}
+
+func chunkMatches(data []byte, hash string) bool {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == hash
+}
+
+func openChunk(hash string) (io.ReadCloser, error) {
+	data, err := readChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// storeContent splits r into chunks, stores the ones not already present and
+// writes the manifest. It returns the SHA-256 of the full content.
+func storeContent(r io.Reader) (string, int64, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return "", 0, err
+	}
+
+	hasher := sha256.New()
+	chunks, size, err := storeChunks(io.TeeReader(r, hasher), config.Compression)
+	if err != nil {
+		return "", 0, err
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if err := writeManifest(checksum, Manifest{Size: size, Chunks: chunks}); err != nil {
+		return "", 0, err
+	}
+	return checksum, size, nil
+}
+
+func storeChunks(r io.Reader, codec string) ([]string, int64, error) {
+	chunks := newChunker(r)
+
+	var hashes []string
+	var size int64
+	for {
+		data, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read content: %w", err)
+		}
+		hash, err := writeChunk(data, codec)
+		if err != nil {
+			return nil, 0, err
+		}
+		hashes = append(hashes, hash)
+		size += int64(len(data))
+	}
+	return hashes, size, nil
+}
+
+// writeManifest records manifest for checksum. An existing full manifest is
+// kept, a delta one is replaced so freshly stored content is always whole.
+func writeManifest(checksum string, manifest Manifest) error {
+	if existing, err := readManifest(checksum); err == nil && existing.Base == "" {
+		return nil
+	}
+	return replaceManifest(checksum, manifest)
+}
+
+func replaceManifest(checksum string, manifest Manifest) error {
+	manifestPath, err := objectPath("manifests", checksum)
+	if err != nil {
+		return err
+	}
+	manifest.Checksum = checksum
+	jsonData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if jsonData, err = sealBlob("manifests/"+filepath.Base(manifestPath), jsonData); err != nil {
+		return fmt.Errorf("failed to encrypt manifest %s: %w", checksum, err)
+	}
+	if err := writeFileAtomic(manifestPath, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %w", checksum, err)
+	}
+	return nil
+}
+
+func readManifest(checksum string) (Manifest, error) {
+	name, err := objectName(checksum)
+	if err != nil {
+		return Manifest{}, err
+	}
+	manifest, err := readStoredManifest(name)
+	if err != nil {
+		return manifest, fmt.Errorf("manifest %s: %w", checksum, err)
+	}
+	return manifest, nil
+}
+
+// readStoredManifest reads the manifest stored under name. Manifests written
+// before they recorded their checksum are named by it.
+func readStoredManifest(name string) (Manifest, error) {
+	var manifest Manifest
+
+	manifestPath, err := storedObjectPath("manifests", name)
+	if err != nil {
+		return manifest, err
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return manifest, fmt.Errorf("missing manifest: %w", err)
+	}
+	if data, err = openBlob("manifests/"+name, data); err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if manifest.Checksum == "" {
+		manifest.Checksum = name
+	}
+	return manifest, nil
+}
+
+type manifestReader struct {
+	chunks  []string
+	current io.ReadCloser
+}
+
+func (m *manifestReader) Read(p []byte) (int, error) {
+	for {
+		if m.current == nil {
+			if len(m.chunks) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := openChunk(m.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			m.chunks = m.chunks[1:]
+			m.current = chunk
+		}
+
+		n, err := m.current.Read(p)
+		if err == io.EOF {
+			m.current.Close()
+			m.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (m *manifestReader) Close() error {
+	if m.current != nil {
+		return m.current.Close()
+	}
+	return nil
+}
+
+func openManifest(checksum string) (io.ReadCloser, error) {
+	manifest, err := readManifest(checksum)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Base != "" {
+		content, err := readManifestContent(checksum)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	return &manifestReader{chunks: manifest.Chunks}, nil
+}
+
+// maxDeltaChain bounds how many deltas are followed to rebuild content, so a
+// corrupt store with a cycle fails instead of looping.
+const maxDeltaChain = 1000
+
+// readManifestContent rebuilds content in memory, applying the delta chain
+// from the nearest full manifest.
+func readManifestContent(checksum string) ([]byte, error) {
+	var chain []Manifest
+	current := checksum
+	for {
+		manifest, err := readManifest(current)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Base == "" {
+			reader := &manifestReader{chunks: manifest.Chunks}
+			content, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return nil, err
+			}
+			for i := len(chain) - 1; i >= 0; i-- {
+				content, err = applyDeltaChunks(content, chain[i])
+				if err != nil {
+					return nil, fmt.Errorf("failed to apply delta for %s: %w", checksum, err)
+				}
+			}
+			if len(chain) > 0 && !chunkMatches(content, checksum) {
+				return nil, fmt.Errorf("content rebuilt from deltas does not match %s", checksum)
+			}
+			return content, nil
+		}
+		if len(chain) >= maxDeltaChain {
+			return nil, fmt.Errorf("delta chain of %s is too long", checksum)
+		}
+		chain = append(chain, manifest)
+		current = manifest.Base
+	}
+}
+
+func applyDeltaChunks(base []byte, manifest Manifest) ([]byte, error) {
+	if manifest.Size > maxDeltaInput {
+		return nil, fmt.Errorf("delta target of %d bytes exceeds %d", manifest.Size, maxDeltaInput)
+	}
+	reader := &manifestReader{chunks: manifest.Delta}
+	defer reader.Close()
+	delta, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return applyDelta(base, delta, manifest.Size)
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// openVersion returns the content of versionID stored in versionDir. Versions
+// written before the chunk store existed are plain vN files in versionDir.
+func openVersion(versionDir, versionID string) (io.ReadCloser, error) {
+	legacyPath := filepath.Join(versionDir, versionID)
+	if data, err := readMetaFile(legacyPath); err == nil {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	allVersions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range *allVersions {
+		if meta.ID == versionID {
+			if meta.IsDir {
+				return nil, fmt.Errorf("version %s is a directory snapshot", versionID)
+			}
+			return openManifest(meta.Checksum)
+		}
+	}
+	return nil, fmt.Errorf("version %s does not exist", versionID)
+}
+
+// openContent opens either a regular file or a version path of the form
+// <versionDir>/<versionID> as returned by ReturnLastFilePath.
+func openContent(path string) (io.ReadCloser, error) {
+	versionDir := filepath.Dir(path)
+	if versionIDPattern.MatchString(filepath.Base(path)) {
+		if _, err := FindVersion(versionDir, filepath.Base(path)); err == nil {
+			return openVersion(versionDir, filepath.Base(path))
+		}
+	}
+	return os.Open(path)
+}
+
+func readContent(path string) ([]byte, error) {
+	reader, err := openContent(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// collectGarbage removes manifests no version references anymore and chunks
+// no remaining manifest references. It works on the stored names.
+func collectGarbage() error {
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return err
+	}
+
+	var liveManifests map[string]bool
+	err = withIndex(false, func(tx *bolt.Tx) error {
+		liveManifests = liveContent(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// content stored as a delta keeps its base alive
+	pending := make([]string, 0, len(liveManifests))
+	for name := range liveManifests {
+		pending = append(pending, name)
+	}
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		manifest, err := readStoredManifest(name)
+		if err != nil || manifest.Base == "" {
+			continue
+		}
+		base, err := objectName(manifest.Base)
+		if err != nil {
+			return err
+		}
+		if !liveManifests[base] {
+			liveManifests[base] = true
+			pending = append(pending, base)
+		}
+	}
+
+	liveChunks := make(map[string]bool)
+	err = walkObjects(filepath.Join(godexDir, "manifests"), func(name, path string) error {
+		if !liveManifests[name] {
+			return os.Remove(path)
+		}
+		manifest, err := readStoredManifest(name)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range append(manifest.Chunks, manifest.Delta...) {
+			chunkName, err := objectName(chunk)
+			if err != nil {
+				return err
+			}
+			liveChunks[chunkName] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sweep manifests: %w", err)
+	}
+
+	err = walkObjects(filepath.Join(godexDir, "objects"), func(name, path string) error {
+		if !liveChunks[name] {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sweep chunks: %w", err)
+	}
+	return nil
+}
+
+// walkManifests calls fn with the checksum of every stored manifest, or with
+// the error reading it and its stored name.
+func walkManifests(fn func(checksum string, manifest Manifest, err error) error) error {
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return err
+	}
+	return walkObjects(filepath.Join(godexDir, "manifests"), func(name, path string) error {
+		manifest, err := readStoredManifest(name)
+		if err != nil {
+			return fn(name, manifest, err)
+		}
+		return fn(manifest.Checksum, manifest, nil)
+	})
+}
+
+func walkObjects(root string, fn func(hash, path string) error) error {
+	prefixes, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, prefix.Name())
+		objects, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if object.IsDir() || object.Name()[0] == '.' {
+				continue
+			}
+			if err := fn(object.Name(), filepath.Join(dir, object.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package version
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Patches carry a change between two versions of a text file to a copy of the
+// file with its own history. They are plain unified diffs, so patch and git
+// apply read them too. Applying looks for every hunk near the line it names
+// first and then further away; with fuzz, up to that many context lines at
+// each end of a hunk may differ. Hunks that do not fit are rejected and
+// returned in patch format, the others are applied.
+
+const (
+	HunkApplied        = "applied"
+	HunkAlreadyApplied = "already applied"
+	HunkRejected       = "rejected"
+)
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// MakePatch returns the change from version fromID to version toID, or to the
+// working copy at workingPath when toID is empty, as a unified diff with
+// a/name and b/name as file names.
+func MakePatch(versionDir, fromID, toID, workingPath, name string, context int) (string, error) {
+	var patch string
+	err := withLocks("", false, func() error {
+		var err error
+		patch, err = makePatch(versionDir, fromID, toID, workingPath, name, context)
+		return err
+	})
+	return patch, err
+}
+
+func makePatch(versionDir, fromID, toID, workingPath, name string, context int) (string, error) {
+	from, err := readPatchSide(versionDir, fromID, "")
+	if err != nil {
+		return "", err
+	}
+	to, err := readPatchSide(versionDir, toID, workingPath)
+	if err != nil {
+		return "", err
+	}
+	if isBinary(from) || isBinary(to) {
+		return "", fmt.Errorf("cannot make a patch of binary content")
+	}
+	result, err := diffContent(from, to, DiffOptions{Context: context})
+	if err != nil {
+		return "", err
+	}
+	name = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/")
+	result.OldName = "a/" + name
+	result.NewName = "b/" + name
+	return FormatUnifiedDiff(result), nil
+}
+
+func readPatchSide(versionDir, versionID, workingPath string) ([]byte, error) {
+	if versionID == "" {
+		return os.ReadFile(workingPath)
+	}
+	meta, err := FindVersion(versionDir, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if meta.IsDir {
+		return nil, fmt.Errorf("version %s is a directory snapshot, only files can be patched", versionID)
+	}
+	return readContent(filepath.Join(versionDir, versionID))
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// patchHunk is a parsed hunk. Lines keep their newline, except a last line
+// marked with "\ No newline at end of file". ops holds ' ', '-' or '+' for
+// every line of the hunk as it appears in the patch.
+type patchHunk struct {
+	newStart int
+	old      []string
+	new      []string
+	ops      []byte
+	text     string
+}
+
+// context returns the number of context lines at the start and at the end of
+// the hunk, which fuzz may ignore.
+func (h patchHunk) context() (int, int) {
+	lead := 0
+	for lead < len(h.ops) && h.ops[lead] == ' ' {
+		lead++
+	}
+	trail := 0
+	for trail < len(h.ops)-lead && h.ops[len(h.ops)-1-trail] == ' ' {
+		trail++
+	}
+	return lead, trail
+}
+
+// reversed is the hunk that undoes h.
+func (h patchHunk) reversed() patchHunk {
+	reverse := patchHunk{newStart: h.newStart, old: h.new, new: h.old, ops: make([]byte, len(h.ops))}
+	for i, op := range h.ops {
+		switch op {
+		case '+':
+			reverse.ops[i] = '-'
+		case '-':
+			reverse.ops[i] = '+'
+		default:
+			reverse.ops[i] = op
+		}
+	}
+	return reverse
+}
+
+type ApplyOptions struct {
+	Fuzz   int
+	DryRun bool
+}
+
+type HunkResult struct {
+	Hunk   int
+	Status string
+	// Line is where the hunk starts in the result, Offset how far that is from
+	// where the patch puts it
+	Line   int
+	Offset int
+	Fuzz   int
+}
+
+type ApplyResult struct {
+	Hunks []HunkResult
+	// Rejected holds the rejected hunks as a patch, empty when all of them fit
+	Rejected string
+}
+
+// parsePatch reads the file header and the hunks of a patch for one file.
+// Text before them, like a commit message, is skipped.
+func parsePatch(data []byte) (string, []patchHunk, error) {
+	var header string
+	var hunks []patchHunk
+	oldLeft, newLeft := 0, 0
+	files := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if (oldLeft > 0 || newLeft > 0) && !strings.HasPrefix(line, `\`) {
+			hunk := &hunks[len(hunks)-1]
+			if line == "" {
+				// some tools strip the space of empty context lines
+				line = " "
+			}
+			text := line[1:] + "\n"
+			switch line[0] {
+			case ' ':
+				hunk.old = append(hunk.old, text)
+				hunk.new = append(hunk.new, text)
+				oldLeft--
+				newLeft--
+			case '-':
+				hunk.old = append(hunk.old, text)
+				oldLeft--
+			case '+':
+				hunk.new = append(hunk.new, text)
+				newLeft--
+			default:
+				return "", nil, fmt.Errorf("malformed hunk %d: unexpected line %q", len(hunks), line)
+			}
+			if oldLeft < 0 || newLeft < 0 {
+				return "", nil, fmt.Errorf("malformed hunk %d: more lines than its header says", len(hunks))
+			}
+			hunk.ops = append(hunk.ops, line[0])
+			hunk.text += line + "\n"
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, `\`):
+			if len(hunks) == 0 || len(hunks[len(hunks)-1].ops) == 0 {
+				return "", nil, fmt.Errorf("malformed patch: %q outside a hunk", line)
+			}
+			// the marker belongs to the line before it
+			hunk := &hunks[len(hunks)-1]
+			op := hunk.ops[len(hunk.ops)-1]
+			if op != '+' {
+				hunk.old[len(hunk.old)-1] = strings.TrimSuffix(hunk.old[len(hunk.old)-1], "\n")
+			}
+			if op != '-' {
+				hunk.new[len(hunk.new)-1] = strings.TrimSuffix(hunk.new[len(hunk.new)-1], "\n")
+			}
+			hunk.text += line + "\n"
+		case strings.HasPrefix(line, "--- "):
+			if files++; files > 1 {
+				return "", nil, fmt.Errorf("the patch changes more than one file")
+			}
+			header = line + "\n"
+		case strings.HasPrefix(line, "+++ "):
+			header += line + "\n"
+		default:
+			match := hunkHeaderPattern.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			hunk := patchHunk{text: line + "\n"}
+			hunk.newStart, _ = strconv.Atoi(match[3])
+			oldLeft, newLeft = 1, 1
+			if match[2] != "" {
+				oldLeft, _ = strconv.Atoi(match[2])
+			}
+			if match[4] != "" {
+				newLeft, _ = strconv.Atoi(match[4])
+			}
+			hunks = append(hunks, hunk)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	if oldLeft > 0 || newLeft > 0 {
+		return "", nil, fmt.Errorf("malformed hunk %d: the patch ends inside it", len(hunks))
+	}
+	if len(hunks) == 0 {
+		return "", nil, fmt.Errorf("the patch has no hunks")
+	}
+	return header, hunks, nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// ApplyPatch applies a patch to filePath. The file is written when at least
+// one hunk was applied and DryRun is not set.
+func ApplyPatch(filePath string, patch []byte, opts ApplyOptions) (ApplyResult, error) {
+	var result ApplyResult
+	header, hunks, err := parsePatch(patch)
+	if err != nil {
+		return result, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return result, err
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return result, err
+	}
+	if isBinary(content) {
+		return result, fmt.Errorf("cannot patch binary content")
+	}
+
+	lines := splitLines(string(content))
+	// drift is the offset of the last hunk found, which the next one likely
+	// shares; floor keeps a hunk from landing before the one applied before it
+	drift, floor, rejectedGrowth := 0, 0, 0
+	applied := 0
+	var rejected strings.Builder
+	for i, hunk := range hunks {
+		hunkResult := HunkResult{Hunk: i + 1, Status: HunkRejected}
+		// the patch places hunks by their line in the new file, which counts
+		// the lines added by earlier hunks, rejected ones included
+		base := hunk.newStart - 1 - rejectedGrowth
+		if len(hunk.new) == 0 {
+			// a hunk that leaves no lines names the line it follows
+			base++
+		}
+
+		if pos, fuzz, lead, trail, ok := findHunk(lines, hunk, base+drift, floor, opts.Fuzz); ok {
+			replacement := hunk.new[lead : len(hunk.new)-trail]
+			end := pos + len(hunk.old) - lead - trail
+			lines = append(lines[:pos], append(append([]string{}, replacement...), lines[end:]...)...)
+			hunkResult.Status = HunkApplied
+			hunkResult.Line = pos - lead + 1
+			hunkResult.Offset = pos - lead - base
+			hunkResult.Fuzz = fuzz
+			drift = hunkResult.Offset
+			floor = pos + len(replacement)
+			applied++
+		} else if pos, fuzz, lead, _, ok := findHunk(lines, hunk.reversed(), base+drift, 0, opts.Fuzz); ok &&
+			bytes.IndexByte(hunk.ops, '+') >= 0 {
+			// the added lines are already there with their context, so applying
+			// the same patch twice is harmless
+			hunkResult.Status = HunkAlreadyApplied
+			hunkResult.Line = pos - lead + 1
+			hunkResult.Offset = pos - lead - base
+			hunkResult.Fuzz = fuzz
+			drift = hunkResult.Offset
+		} else {
+			rejected.WriteString(hunk.text)
+			rejectedGrowth += len(hunk.new) - len(hunk.old)
+		}
+		result.Hunks = append(result.Hunks, hunkResult)
+	}
+	if rejected.Len() > 0 {
+		result.Rejected = header + rejected.String()
+	}
+
+	if applied > 0 && !opts.DryRun {
+		if err := writeFileAtomic(filePath, []byte(strings.Join(lines, "")), info.Mode().Perm()); err != nil {
+			return result, fmt.Errorf("failed to write %s: %w", filePath, err)
+		}
+	}
+	return result, nil
+}
+
+// findHunk looks for the old side of hunk, at expected first and then
+// further away, never before floor. Each fuzz level drops one more context
+// line at both ends of the hunk. It returns where the matched lines start and
+// how many context lines were dropped at the start and the end.
+func findHunk(lines []string, hunk patchHunk, expected, floor, maxFuzz int) (int, int, int, int, bool) {
+	lead, trail := hunk.context()
+	for fuzz := 0; fuzz <= maxFuzz; fuzz++ {
+		dropLead, dropTrail := min(fuzz, lead), min(fuzz, trail)
+		old := hunk.old[dropLead : len(hunk.old)-dropTrail]
+		if pos, ok := findLines(lines, old, expected+dropLead, floor); ok {
+			return pos, fuzz, dropLead, dropTrail, true
+		}
+		if dropLead == lead && dropTrail == trail {
+			break
+		}
+	}
+	return 0, 0, 0, 0, false
+}
+
+// findLines returns the position of want in lines closest to expected, at or
+// after floor.
+func findLines(lines, want []string, expected, floor int) (int, bool) {
+	last := len(lines) - len(want)
+	if last < floor {
+		return 0, false
+	}
+	expected = max(floor, min(expected, last))
+	matches := func(pos int) bool {
+		for i, line := range want {
+			if lines[pos+i] != line {
+				return false
+			}
+		}
+		return true
+	}
+	for distance := 0; expected-distance >= floor || expected+distance <= last; distance++ {
+		if pos := expected - distance; pos >= floor && matches(pos) {
+			return pos, true
+		}
+		if pos := expected + distance; distance > 0 && pos <= last && matches(pos) {
+			return pos, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,183 @@
+package version
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patch    string
+		hunks    int
+		wantOld  []string
+		wantNew  []string
+		wantErr  bool
+		wantHead string
+	}{
+		{
+			name:     "message before the diff",
+			patch:    "Fix the greeting\n\n--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n a\n-b\n+B\n",
+			hunks:    1,
+			wantOld:  []string{"a\n", "b\n"},
+			wantNew:  []string{"a\n", "B\n"},
+			wantHead: "--- a/f\n+++ b/f\n",
+		},
+		{
+			name:     "missing newline at the end",
+			patch:    "--- a/f\n+++ b/f\n@@ -1 +1 @@\n-a\n+a\n\\ No newline at end of file\n",
+			hunks:    1,
+			wantOld:  []string{"a\n"},
+			wantNew:  []string{"a"},
+			wantHead: "--- a/f\n+++ b/f\n",
+		},
+		{
+			name:     "stripped space of an empty context line",
+			patch:    "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n\n-b\n+B\n",
+			hunks:    1,
+			wantOld:  []string{"\n", "b\n"},
+			wantNew:  []string{"\n", "B\n"},
+			wantHead: "--- a/f\n+++ b/f\n",
+		},
+		{
+			name:  "two hunks",
+			patch: "--- a/f\n+++ b/f\n@@ -1 +1 @@\n-a\n+A\n@@ -9 +9 @@\n-i\n+I\n",
+			hunks: 2,
+		},
+		{name: "no hunks", patch: "--- a/f\n+++ b/f\n", wantErr: true},
+		{name: "two files", patch: "--- a/f\n+++ b/f\n@@ -1 +1 @@\n-a\n+A\n--- a/g\n+++ b/g\n", wantErr: true},
+		{name: "ends inside a hunk", patch: "--- a/f\n+++ b/f\n@@ -1,3 +1,3 @@\n a\n", wantErr: true},
+		{name: "more lines than the header says", patch: "--- a/f\n+++ b/f\n@@ -1,2 +1 @@\n a\n+A\n-b\n", wantErr: true},
+		{name: "unexpected line", patch: "--- a/f\n+++ b/f\n@@ -1 +1 @@\n*a\n", wantErr: true},
+		{name: "marker outside a hunk", patch: "\\ No newline at end of file\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, hunks, err := parsePatch([]byte(tt.patch))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsed %d hunks, want an error", len(hunks))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hunks) != tt.hunks {
+				t.Fatalf("got %d hunks, want %d", len(hunks), tt.hunks)
+			}
+			if tt.wantHead != "" && header != tt.wantHead {
+				t.Errorf("header is %q, want %q", header, tt.wantHead)
+			}
+			if tt.wantOld != nil && !sameLines(hunks[0].old, tt.wantOld) {
+				t.Errorf("old side is %q, want %q", hunks[0].old, tt.wantOld)
+			}
+			if tt.wantNew != nil && !sameLines(hunks[0].new, tt.wantNew) {
+				t.Errorf("new side is %q, want %q", hunks[0].new, tt.wantNew)
+			}
+		})
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	lines := func(from, to int) string {
+		var sb strings.Builder
+		for i := from; i <= to; i++ {
+			sb.WriteString(strings.Repeat("x", i) + "\n")
+		}
+		return sb.String()
+	}
+	original := lines(1, 10)
+	changed := strings.Replace(strings.Replace(original, "xx\n", "two\n", 1), "xxxxxxxxx\n", "nine\n", 1)
+	result, err := diffContent([]byte(original), []byte(changed), DiffOptions{Context: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.OldName, result.NewName = "a/f", "b/f"
+	patch := FormatUnifiedDiff(result)
+
+	tests := []struct {
+		name     string
+		content  string
+		fuzz     int
+		want     string
+		statuses []string
+	}{
+		{
+			name:     "clean",
+			content:  original,
+			want:     changed,
+			statuses: []string{HunkApplied, HunkApplied},
+		},
+		{
+			name:     "lines moved down",
+			content:  "new first line\n" + original,
+			want:     "new first line\n" + changed,
+			statuses: []string{HunkApplied, HunkApplied},
+		},
+		{
+			name:     "already applied",
+			content:  changed,
+			want:     changed,
+			statuses: []string{HunkAlreadyApplied, HunkAlreadyApplied},
+		},
+		{
+			name:     "changed context is rejected without fuzz",
+			content:  strings.Replace(original, "xxxxxxx\n", "seven\n", 1),
+			want:     strings.Replace(strings.Replace(original, "xxxxxxx\n", "seven\n", 1), "xx\n", "two\n", 1),
+			statuses: []string{HunkApplied, HunkRejected},
+		},
+		{
+			name:     "changed context applies with fuzz",
+			content:  strings.Replace(original, "xxxxxxx\n", "seven\n", 1),
+			fuzz:     2,
+			want:     strings.Replace(changed, "xxxxxxx\n", "seven\n", 1),
+			statuses: []string{HunkApplied, HunkApplied},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "f")
+			if err := os.WriteFile(filePath, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			applied, err := ApplyPatch(filePath, []byte(patch), ApplyOptions{Fuzz: tt.fuzz})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statuses []string
+			for _, hunk := range applied.Hunks {
+				statuses = append(statuses, hunk.Status)
+			}
+			if strings.Join(statuses, ",") != strings.Join(tt.statuses, ",") {
+				t.Errorf("hunks are %v, want %v", statuses, tt.statuses)
+			}
+			content, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", content, tt.want)
+			}
+
+			rejects := 0
+			for _, status := range statuses {
+				if status == HunkRejected {
+					rejects++
+				}
+			}
+			if rejects == 0 && applied.Rejected != "" {
+				t.Errorf("rejected %q although every hunk fit", applied.Rejected)
+			}
+			if rejects > 0 {
+				if _, hunks, err := parsePatch([]byte(applied.Rejected)); err != nil || len(hunks) != rejects {
+					t.Errorf("the rejects are not a patch of %d hunks: %v\n%s", rejects, err, applied.Rejected)
+				}
+			}
+		})
+	}
+}
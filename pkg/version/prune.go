@@ -0,0 +1,308 @@
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A retention policy decides which versions of a file survive a prune. The
+// keep rules select versions to keep, and when any of them is set everything
+// they do not select is removed. MaxAge and MaxBytes are limits on top of that,
+// removing the oldest remaining versions until they hold. The version the
+// working copy is based on and tagged versions are never removed. The Auto
+// limits only apply to versions created by godex watch.
+
+type RetentionPolicy struct {
+	KeepLast     int    `json:",omitempty"`
+	KeepDaily    int    `json:",omitempty"`
+	KeepWeekly   int    `json:",omitempty"`
+	KeepMonthly  int    `json:",omitempty"`
+	MaxBytes     int64  `json:",omitempty"`
+	MaxAge       string `json:",omitempty"`
+	AutoKeepLast int    `json:",omitempty"`
+	AutoMaxAge   string `json:",omitempty"`
+}
+
+type PruneEntry struct {
+	Version VersionMetaData
+	Reason  string
+}
+
+type PrunePlan struct {
+	Keep   []PruneEntry
+	Remove []PruneEntry
+}
+
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+func (p RetentionPolicy) hasKeepRules() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+// ParseAge parses a duration like 90m, 12h, 30d or 2w.
+func ParseAge(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			n, err := strconv.Atoi(number)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid age %q", value)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+	return age, nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func LoadPolicy(versionDir string) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	data, err := os.ReadFile(filepath.Join(versionDir, "policy.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return policy, nil
+		}
+		return policy, fmt.Errorf("failed to read retention policy: %w", err)
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse retention policy: %w", err)
+	}
+	return policy, nil
+}
+
+// SavePolicy stores the policy version create applies to this file. A zero
+// policy removes it.
+func SavePolicy(versionDir string, policy RetentionPolicy) error {
+	return withLocks(versionDir, false, func() error {
+		return savePolicy(versionDir, policy)
+	})
+}
+
+func savePolicy(versionDir string, policy RetentionPolicy) error {
+	policyPath := filepath.Join(versionDir, "policy.json")
+	if policy.IsZero() {
+		if err := os.Remove(policyPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove retention policy: %w", err)
+		}
+		return nil
+	}
+	for _, age := range []string{policy.MaxAge, policy.AutoMaxAge} {
+		if age == "" {
+			continue
+		}
+		if _, err := ParseAge(age); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		return err
+	}
+	jsonData, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal retention policy to JSON")
+	}
+	if err := writeFileAtomic(policyPath, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write retention policy: %w", err)
+	}
+	return nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// keepBuckets keeps the newest version of each of the last count periods, as
+// told apart by key. versions are ordered newest first.
+func keepBuckets(versions []VersionMetaData, count int, name string, key func(time.Time) string, reasons map[string]string) {
+	seen := make(map[string]bool)
+	for _, meta := range versions {
+		if len(seen) >= count {
+			return
+		}
+		bucket := key(meta.CreatedAt.Local())
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		if _, ok := reasons[meta.ID]; !ok {
+			reasons[meta.ID] = name + " " + bucket
+		}
+	}
+}
+
+// PlanPrune works out which versions policy keeps, without changing anything.
+func PlanPrune(versionDir string, policy RetentionPolicy, now time.Time) (PrunePlan, error) {
+	var plan PrunePlan
+
+	var maxAge time.Duration
+	if policy.MaxAge != "" {
+		age, err := ParseAge(policy.MaxAge)
+		if err != nil {
+			return plan, err
+		}
+		maxAge = age
+	}
+	var autoMaxAge time.Duration
+	if policy.AutoMaxAge != "" {
+		age, err := ParseAge(policy.AutoMaxAge)
+		if err != nil {
+			return plan, err
+		}
+		autoMaxAge = age
+	}
+
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return plan, err
+	}
+	tags, err := VersionTags(versionDir)
+	if err != nil {
+		return plan, err
+	}
+	head := readHead(versionDir)
+
+	newestFirst := make([]VersionMetaData, len(*versions))
+	for i, meta := range *versions {
+		newestFirst[len(*versions)-1-i] = meta
+	}
+
+	reasons := make(map[string]string)
+	protected := make(map[string]bool)
+	if head != "" {
+		reasons[head] = "HEAD"
+		protected[head] = true
+	}
+	for id, names := range tags {
+		if _, ok := reasons[id]; !ok {
+			reasons[id] = "tag " + strings.Join(names, ", ")
+		}
+		protected[id] = true
+	}
+
+	if policy.hasKeepRules() {
+		for i, meta := range newestFirst {
+			if i >= policy.KeepLast {
+				break
+			}
+			if _, ok := reasons[meta.ID]; !ok {
+				reasons[meta.ID] = "last"
+			}
+		}
+		keepBuckets(newestFirst, policy.KeepDaily, "daily", func(t time.Time) string {
+			return t.Format("2006-01-02")
+		}, reasons)
+		keepBuckets(newestFirst, policy.KeepWeekly, "weekly", func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}, reasons)
+		keepBuckets(newestFirst, policy.KeepMonthly, "monthly", func(t time.Time) string {
+			return t.Format("2006-01")
+		}, reasons)
+	} else {
+		for _, meta := range newestFirst {
+			if _, ok := reasons[meta.ID]; !ok {
+				reasons[meta.ID] = "no keep rule"
+			}
+		}
+	}
+
+	removed := make(map[string]string)
+	var total int64
+	autoKept := 0
+	for _, meta := range newestFirst {
+		if _, ok := reasons[meta.ID]; !ok {
+			removed[meta.ID] = "not selected by a keep rule"
+			continue
+		}
+		if maxAge > 0 && !protected[meta.ID] && now.Sub(meta.CreatedAt) > maxAge {
+			removed[meta.ID] = "older than " + policy.MaxAge
+			continue
+		}
+		if meta.Auto && !protected[meta.ID] {
+			if autoMaxAge > 0 && now.Sub(meta.CreatedAt) > autoMaxAge {
+				removed[meta.ID] = "auto version older than " + policy.AutoMaxAge
+				continue
+			}
+			if policy.AutoKeepLast > 0 && autoKept >= policy.AutoKeepLast {
+				removed[meta.ID] = fmt.Sprintf("more than %d auto versions", policy.AutoKeepLast)
+				continue
+			}
+			autoKept++
+		}
+		total += meta.Size
+	}
+
+	// the byte limit drops the oldest unprotected versions first
+	if policy.MaxBytes > 0 {
+		for i := len(newestFirst) - 1; i >= 0 && total > policy.MaxBytes; i-- {
+			meta := newestFirst[i]
+			if _, ok := removed[meta.ID]; ok || protected[meta.ID] {
+				continue
+			}
+			removed[meta.ID] = fmt.Sprintf("over %d bytes", policy.MaxBytes)
+			total -= meta.Size
+		}
+	}
+
+	for _, meta := range *versions {
+		if reason, ok := removed[meta.ID]; ok {
+			plan.Remove = append(plan.Remove, PruneEntry{Version: meta, Reason: reason})
+		} else {
+			plan.Keep = append(plan.Keep, PruneEntry{Version: meta, Reason: reasons[meta.ID]})
+		}
+	}
+	return plan, nil
+}
+
+// Prune removes the versions policy does not keep. With dryRun set only the
+// plan is returned.
+func Prune(versionDir string, policy RetentionPolicy, dryRun bool) (PrunePlan, error) {
+	if dryRun {
+		return PlanPrune(versionDir, policy, time.Now())
+	}
+	var plan PrunePlan
+	err := withLocks(versionDir, true, func() error {
+		var err error
+		plan, err = prune(versionDir, policy)
+		return err
+	})
+	return plan, err
+}
+
+func prune(versionDir string, policy RetentionPolicy) (PrunePlan, error) {
+	plan, err := PlanPrune(versionDir, policy, time.Now())
+	if err != nil || len(plan.Remove) == 0 {
+		return plan, err
+	}
+
+	ids := make(map[string]bool, len(plan.Remove))
+	for _, entry := range plan.Remove {
+		ids[entry.Version.ID] = true
+	}
+	if err := removeVersions(versionDir, ids); err != nil {
+		return plan, err
+	}
+	return plan, nil
+}
+
+// applyPolicy prunes with the policy stored for the file, if there is one.
+func applyPolicy(versionDir string) error {
+	policy, err := LoadPolicy(versionDir)
+	if err != nil || policy.IsZero() {
+		return err
+	}
+	_, err = prune(versionDir, policy)
+	return err
+}
@@ -0,0 +1,277 @@
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every version records the version it was created from in Parent, so creating
+// a version after restoring an older one starts a branch instead of extending
+// the latest line. Tags are stored per file in the index as name -> version ID.
+
+var (
+	versionIDPattern = regexp.MustCompile(`^v[0-9]+$`)
+	tagNamePattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+)
+
+// parentIDs returns the parent of every version. Versions written before
+// parents were recorded form a single line, so each of them is the child of
+// the entry before it.
+func parentIDs(versions []VersionMetaData) map[string]string {
+	legacy := len(versions)
+	for i, meta := range versions {
+		if meta.Parent != "" {
+			legacy = i
+			break
+		}
+	}
+
+	parents := make(map[string]string, len(versions))
+	for i, meta := range versions {
+		parent := meta.Parent
+		if parent == "" && i > 0 && i < legacy {
+			parent = versions[i-1].ID
+		}
+		parents[meta.ID] = parent
+	}
+	return parents
+}
+
+// mergeBase returns the nearest common ancestor of ours and theirs. Merge
+// versions have two parents and both are followed. ours may name several
+// versions, like HEAD and a merged version not recorded in a version yet.
+func mergeBase(versionDir string, ours []string, theirs string) (string, error) {
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return "", err
+	}
+	parents := parentIDs(*versions)
+	mergeParents := make(map[string]string)
+	for _, meta := range *versions {
+		if meta.MergeParent != "" {
+			mergeParents[meta.ID] = meta.MergeParent
+		}
+	}
+	// walk visits the ancestors of ids breadth first, nearest first
+	walk := func(ids []string, visit func(string) bool) {
+		seen := make(map[string]bool)
+		for len(ids) > 0 {
+			id := ids[0]
+			ids = ids[1:]
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			if visit(id) {
+				return
+			}
+			ids = append(ids, parents[id], mergeParents[id])
+		}
+	}
+
+	ancestors := make(map[string]bool)
+	walk(ours, func(id string) bool {
+		ancestors[id] = true
+		return false
+	})
+	base := ""
+	walk([]string{theirs}, func(id string) bool {
+		if ancestors[id] {
+			base = id
+		}
+		return base != ""
+	})
+	if base == "" {
+		return "", fmt.Errorf("no common ancestor of %s and %s", strings.Join(ours, ", "), theirs)
+	}
+	return base, nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func ListTags(versionDir string) (map[string]string, error) {
+	var tags map[string]string
+	err := withIndex(false, func(tx *bolt.Tx) error {
+		var err error
+		tags, err = loadTags(tx, versionDir)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tags: %w", err)
+	}
+	return tags, nil
+}
+
+func saveTags(versionDir string, tags map[string]string) error {
+	err := withIndex(true, func(tx *bolt.Tx) error {
+		return storeTags(tx, versionDir, tags)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write tags: %w", err)
+	}
+	return nil
+}
+
+// TagVersion gives versionID the name tag. An existing tag of the same name is
+// moved to the new version.
+func TagVersion(versionDir, versionID, tag string) error {
+	if !tagNamePattern.MatchString(tag) {
+		return fmt.Errorf("invalid tag name %q", tag)
+	}
+	if versionIDPattern.MatchString(tag) {
+		return fmt.Errorf("tag name %q looks like a version ID", tag)
+	}
+	if _, err := FindVersion(versionDir, versionID); err != nil {
+		return err
+	}
+
+	return withLocks(versionDir, false, func() error {
+		tags, err := ListTags(versionDir)
+		if err != nil {
+			return err
+		}
+		tags[tag] = versionID
+		return saveTags(versionDir, tags)
+	})
+}
+
+func DeleteTag(versionDir, tag string) error {
+	return withLocks(versionDir, false, func() error {
+		tags, err := ListTags(versionDir)
+		if err != nil {
+			return err
+		}
+		if _, ok := tags[tag]; !ok {
+			return fmt.Errorf("tag %s does not exist", tag)
+		}
+		delete(tags, tag)
+		return saveTags(versionDir, tags)
+	})
+}
+
+// ResolveVersion turns a version ID or a tag name into a version ID.
+func ResolveVersion(versionDir, ref string) (string, error) {
+	if _, err := FindVersion(versionDir, ref); err == nil {
+		return ref, nil
+	}
+	tags, err := ListTags(versionDir)
+	if err != nil {
+		return "", err
+	}
+	if id, ok := tags[ref]; ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("no version or tag named %s", ref)
+}
+
+func tagsByVersion(tags map[string]string) map[string][]string {
+	byVersion := make(map[string][]string)
+	for name, id := range tags {
+		byVersion[id] = append(byVersion[id], name)
+	}
+	for id := range byVersion {
+		sort.Strings(byVersion[id])
+	}
+	return byVersion
+}
+
+// VersionTags returns the tag names of every tagged version.
+func VersionTags(versionDir string) (map[string][]string, error) {
+	tags, err := ListTags(versionDir)
+	if err != nil {
+		return nil, err
+	}
+	return tagsByVersion(tags), nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+// FormatVersionGraph draws the history newest first, one column per branch,
+// in the style of git log --graph.
+func FormatVersionGraph(versionDir string) (string, error) {
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return "", err
+	}
+	tags, err := VersionTags(versionDir)
+	if err != nil {
+		return "", err
+	}
+	parents := parentIDs(*versions)
+	head := readHead(versionDir)
+
+	var sb strings.Builder
+	var lanes []string
+	for i := len(*versions) - 1; i >= 0; i-- {
+		meta := (*versions)[i]
+
+		column := -1
+		for j, id := range lanes {
+			if id == meta.ID {
+				column = j
+				break
+			}
+		}
+		if column == -1 {
+			lanes = append(lanes, meta.ID)
+			column = len(lanes) - 1
+		}
+
+		// branches that forked from this version join its lane first
+		for j := len(lanes) - 1; j > column; j-- {
+			if lanes[j] != meta.ID {
+				continue
+			}
+			var join strings.Builder
+			for k := range lanes {
+				switch {
+				case k < j-1:
+					join.WriteString("| ")
+				case k == j-1:
+					join.WriteString("|/")
+				case k > j:
+					join.WriteString(" /")
+				}
+			}
+			sb.WriteString(strings.TrimRight(join.String(), " ") + "\n")
+			lanes = append(lanes[:j], lanes[j+1:]...)
+		}
+
+		var row strings.Builder
+		for j := range lanes {
+			if j == column {
+				row.WriteString("* ")
+			} else {
+				row.WriteString("| ")
+			}
+		}
+		label := fmt.Sprintf("%s %s %s", meta.ID, meta.CreatedAt.Format("2006-01-02 15:04"), meta.Message)
+		var refs []string
+		if meta.ID == head {
+			refs = append(refs, "HEAD")
+		}
+		if meta.MergeParent != "" {
+			refs = append(refs, "merged: "+meta.MergeParent)
+		}
+		for _, tag := range tags[meta.ID] {
+			refs = append(refs, "tag: "+tag)
+		}
+		if len(refs) > 0 {
+			label += " (" + strings.Join(refs, ", ") + ")"
+		}
+		sb.WriteString(row.String() + label + "\n")
+
+		if parent := parents[meta.ID]; parent != "" {
+			lanes[column] = parent
+		} else {
+			lanes = append(lanes[:column], lanes[column+1:]...)
+		}
+	}
+	return sb.String(), nil
+}
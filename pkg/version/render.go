@@ -0,0 +1,363 @@
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	FormatUnified    = "unified"
+	FormatSideBySide = "side-by-side"
+)
+
+type RenderOptions struct {
+	Format   string
+	WordDiff bool
+	Color    bool
+	// Width is the terminal width used to fit the side-by-side columns.
+	Width int
+}
+
+func DefaultRenderOptions() RenderOptions {
+	return RenderOptions{Format: FormatUnified, Width: 80}
+}
+
+const (
+	ansiReset      = "\x1b[0m"
+	styleHeader    = "\x1b[1m"
+	styleHunk      = "\x1b[36m"
+	styleDelete    = "\x1b[31m"
+	styleInsert    = "\x1b[32m"
+	styleDelWord   = "\x1b[1;37;41m"
+	styleInsWord   = "\x1b[1;30;42m"
+	minColumnWidth = 10
+	tabWidth       = 8
+)
+
+type span struct {
+	text  string
+	style string
+}
+
+func (opts RenderOptions) paint(text, style string) string {
+	if !opts.Color || style == "" || text == "" {
+		return text
+	}
+	return style + text + ansiReset
+}
+
+func (opts RenderOptions) paintSpans(spans []span) string {
+	var sb strings.Builder
+	for _, s := range spans {
+		sb.WriteString(opts.paint(s.text, s.style))
+	}
+	return sb.String()
+}
+
+// RenderDiff renders a line diff in the requested format. Without colors the
+// word level changes are marked the way git does, [-removed-]{+added+}.
+func RenderDiff(result DiffResult, opts RenderOptions) (string, error) {
+	if result.DiffType == "binary" || result.DiffType == "archive" {
+		return renderBinary(result, opts), nil
+	}
+	if result.DiffType == "semantic" {
+		return renderSemantic(result, opts), nil
+	}
+	if result.Identical || len(result.Hunks) == 0 {
+		return "", nil
+	}
+
+	switch opts.Format {
+	case "", FormatUnified:
+		if !opts.Color && !opts.WordDiff {
+			return FormatUnifiedDiff(result), nil
+		}
+		return renderUnified(result, opts), nil
+	case FormatSideBySide:
+		return renderSideBySide(result, opts), nil
+	default:
+		return "", fmt.Errorf("unknown diff format %q", opts.Format)
+	}
+}
+
+// changeBlock is a run of deleted and inserted lines between two unchanged
+// lines. Deleted and inserted lines are paired up in order for rendering.
+type changeBlock struct {
+	deleted  []DiffLine
+	inserted []DiffLine
+}
+
+func walkHunk(hunk DiffHunk, equal func(DiffLine), change func(changeBlock)) {
+	var block changeBlock
+	flush := func() {
+		if len(block.deleted) > 0 || len(block.inserted) > 0 {
+			change(block)
+			block = changeBlock{}
+		}
+	}
+	for _, line := range hunk.Lines {
+		switch line.Op {
+		case LineEqual:
+			flush()
+			equal(line)
+		case LineDelete:
+			block.deleted = append(block.deleted, line)
+		case LineInsert:
+			block.inserted = append(block.inserted, line)
+		}
+	}
+	flush()
+}
+
+func hunkHeader(hunk DiffHunk) string {
+	return fmt.Sprintf("@@ -%s +%s @@",
+		formatRange(hunk.OldStart, hunk.OldLines),
+		formatRange(hunk.NewStart, hunk.NewLines))
+}
+
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}_]+|\s+|[^\p{L}\p{N}_\s]`)
+
+// wordSpans diffs two lines word by word. Unchanged words keep lineStyle and
+// changed words are highlighted, or wrapped in markers when colors are off.
+func wordSpans(oldText, newText string, opts RenderOptions) ([]span, []span) {
+	edits, err := diffTokens(
+		wordPattern.FindAllString(oldText, -1),
+		wordPattern.FindAllString(newText, -1),
+	)
+	if err != nil {
+		return []span{{oldText, styleDelete}}, []span{{newText, styleInsert}}
+	}
+
+	var oldSpans, newSpans []span
+	for _, edit := range edits {
+		switch edit.Op {
+		case LineEqual:
+			oldSpans = append(oldSpans, span{edit.Token, styleDelete})
+			newSpans = append(newSpans, span{edit.Token, styleInsert})
+		case LineDelete:
+			oldSpans = append(oldSpans, markWord(edit.Token, "[-", "-]", styleDelWord, opts))
+		case LineInsert:
+			newSpans = append(newSpans, markWord(edit.Token, "{+", "+}", styleInsWord, opts))
+		}
+	}
+	return mergeSpans(oldSpans), mergeSpans(newSpans)
+}
+
+func markWord(token, open, close, style string, opts RenderOptions) span {
+	if opts.Color {
+		return span{token, style}
+	}
+	return span{open + token + close, ""}
+}
+
+// mergeSpans joins neighbouring spans of the same style, so markers surround
+// whole changed phrases instead of every single word.
+func mergeSpans(spans []span) []span {
+	var merged []span
+	for _, s := range spans {
+		if n := len(merged); n > 0 && merged[n-1].style == s.style {
+			last := &merged[n-1]
+			if s.style == "" && strings.HasSuffix(last.text, "-]") && strings.HasPrefix(s.text, "[-") {
+				last.text = strings.TrimSuffix(last.text, "-]") + strings.TrimPrefix(s.text, "[-")
+				continue
+			}
+			if s.style == "" && strings.HasSuffix(last.text, "+}") && strings.HasPrefix(s.text, "{+") {
+				last.text = strings.TrimSuffix(last.text, "+}") + strings.TrimPrefix(s.text, "{+")
+				continue
+			}
+			if s.style != "" {
+				last.text += s.text
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func renderUnified(result DiffResult, opts RenderOptions) string {
+	var sb strings.Builder
+	sb.WriteString(opts.paint("--- "+result.OldName, styleHeader) + "\n")
+	sb.WriteString(opts.paint("+++ "+result.NewName, styleHeader) + "\n")
+
+	for _, hunk := range result.Hunks {
+		sb.WriteString(opts.paint(hunkHeader(hunk), styleHunk) + "\n")
+		walkHunk(hunk, func(line DiffLine) {
+			if !opts.WordDiff {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(line.Text + "\n")
+		}, func(block changeBlock) {
+			if !opts.WordDiff {
+				for _, line := range block.deleted {
+					sb.WriteString(opts.paint("-"+line.Text, styleDelete) + "\n")
+				}
+				for _, line := range block.inserted {
+					sb.WriteString(opts.paint("+"+line.Text, styleInsert) + "\n")
+				}
+				return
+			}
+			sb.WriteString(renderWordBlock(block, opts))
+		})
+	}
+	return sb.String()
+}
+
+// renderWordBlock merges paired lines into a single line showing the changed
+// words inline, the way git diff --word-diff does.
+func renderWordBlock(block changeBlock, opts RenderOptions) string {
+	var sb strings.Builder
+	paired := min(len(block.deleted), len(block.inserted))
+
+	for i := 0; i < paired; i++ {
+		edits, err := diffTokens(
+			wordPattern.FindAllString(block.deleted[i].Text, -1),
+			wordPattern.FindAllString(block.inserted[i].Text, -1),
+		)
+		if err != nil {
+			sb.WriteString(opts.paintSpans([]span{markWord(block.deleted[i].Text, "[-", "-]", styleDelete, opts)}) + "\n")
+			sb.WriteString(opts.paintSpans([]span{markWord(block.inserted[i].Text, "{+", "+}", styleInsert, opts)}) + "\n")
+			continue
+		}
+		var spans []span
+		for _, edit := range edits {
+			switch edit.Op {
+			case LineEqual:
+				spans = append(spans, span{edit.Token, ""})
+			case LineDelete:
+				spans = append(spans, markWord(edit.Token, "[-", "-]", styleDelete, opts))
+			case LineInsert:
+				spans = append(spans, markWord(edit.Token, "{+", "+}", styleInsert, opts))
+			}
+		}
+		sb.WriteString(opts.paintSpans(mergeSpans(spans)) + "\n")
+	}
+
+	for _, line := range block.deleted[paired:] {
+		sb.WriteString(opts.paintSpans([]span{markWord(line.Text, "[-", "-]", styleDelete, opts)}) + "\n")
+	}
+	for _, line := range block.inserted[paired:] {
+		sb.WriteString(opts.paintSpans([]span{markWord(line.Text, "{+", "+}", styleInsert, opts)}) + "\n")
+	}
+	return sb.String()
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func renderSideBySide(result DiffResult, opts RenderOptions) string {
+	columnWidth := max(minColumnWidth, (opts.Width-3)/2)
+
+	var sb strings.Builder
+	writeRow := func(left []span, marker string, right []span) {
+		leftRows := wrapSpans(expandSpanTabs(left), columnWidth)
+		rightRows := wrapSpans(expandSpanTabs(right), columnWidth)
+		for i := 0; i < max(len(leftRows), len(rightRows)); i++ {
+			var l, r []span
+			if i < len(leftRows) {
+				l = leftRows[i]
+			}
+			if i < len(rightRows) {
+				r = rightRows[i]
+			}
+			sep := marker
+			if i > 0 {
+				sep = "   "
+			}
+			padding := strings.Repeat(" ", columnWidth-spansWidth(l))
+			line := opts.paintSpans(l) + padding + sep + opts.paintSpans(r)
+			sb.WriteString(strings.TrimRight(line, " ") + "\n")
+		}
+	}
+
+	writeRow([]span{{result.OldName, styleHeader}}, "   ", []span{{result.NewName, styleHeader}})
+	sb.WriteString(strings.Repeat("-", columnWidth) + "   " + strings.Repeat("-", columnWidth) + "\n")
+
+	for _, hunk := range result.Hunks {
+		sb.WriteString(opts.paint(hunkHeader(hunk), styleHunk) + "\n")
+		walkHunk(hunk, func(line DiffLine) {
+			writeRow([]span{{line.Text, ""}}, "   ", []span{{line.Text, ""}})
+		}, func(block changeBlock) {
+			paired := min(len(block.deleted), len(block.inserted))
+			for i := 0; i < paired; i++ {
+				left := []span{{block.deleted[i].Text, styleDelete}}
+				right := []span{{block.inserted[i].Text, styleInsert}}
+				if opts.WordDiff {
+					left, right = wordSpans(block.deleted[i].Text, block.inserted[i].Text, opts)
+				}
+				writeRow(left, " | ", right)
+			}
+			for _, line := range block.deleted[paired:] {
+				writeRow([]span{{line.Text, styleDelete}}, " < ", nil)
+			}
+			for _, line := range block.inserted[paired:] {
+				writeRow(nil, " > ", []span{{line.Text, styleInsert}})
+			}
+		})
+	}
+	return sb.String()
+}
+
+func spansWidth(spans []span) int {
+	width := 0
+	for _, s := range spans {
+		width += utf8.RuneCountInString(s.text)
+	}
+	return width
+}
+
+// expandSpanTabs replaces tabs with spaces so the columns stay aligned.
+func expandSpanTabs(spans []span) []span {
+	column := 0
+	expanded := make([]span, 0, len(spans))
+	for _, s := range spans {
+		var sb strings.Builder
+		for _, r := range s.text {
+			if r == '\t' {
+				n := tabWidth - column%tabWidth
+				sb.WriteString(strings.Repeat(" ", n))
+				column += n
+				continue
+			}
+			sb.WriteRune(r)
+			column++
+		}
+		expanded = append(expanded, span{sb.String(), s.style})
+	}
+	return expanded
+}
+
+// wrapSpans cuts styled text into rows of at most width runes.
+func wrapSpans(spans []span, width int) [][]span {
+	rows := [][]span{nil}
+	used := 0
+	for _, s := range spans {
+		text := s.text
+		for text != "" {
+			if used == width {
+				rows = append(rows, nil)
+				used = 0
+			}
+			room := width - used
+			cut := len(text)
+			count := 0
+			for i := range text {
+				if count == room {
+					cut = i
+					break
+				}
+				count++
+			}
+			part := text[:cut]
+			rows[len(rows)-1] = append(rows[len(rows)-1], span{part, s.style})
+			used += utf8.RuneCountInString(part)
+			text = text[cut:]
+		}
+	}
+	return rows
+}
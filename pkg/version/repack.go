@@ -0,0 +1,324 @@
+package version
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Older content is kept as a reverse delta: when a version is created, the
+// content of the version it replaces is stored as a delta against the new
+// content, so the newest version of a file is always whole and reading an
+// older one applies the deltas back from there. Repack rebuilds this for the
+// whole store and cuts chains that got too long.
+
+const (
+	// DefaultMaxChain is the longest delta chain repack leaves in place.
+	DefaultMaxChain = 16
+
+	// content larger than this is never delta encoded, both sides are held in
+	// memory while encoding
+	maxDeltaInput = 256 << 20
+)
+
+type RepackResult struct {
+	Deltified    int
+	Materialized int
+	SizeBefore   int64
+	SizeAfter    int64
+}
+
+// deltify stores oldChecksum as a delta against newChecksum when that saves at
+// least half of its size. Only full content is used as a base, which keeps
+// delta chains free of cycles.
+func deltify(oldChecksum, newChecksum, codec string) (bool, error) {
+	if oldChecksum == "" || newChecksum == "" || oldChecksum == newChecksum {
+		return false, nil
+	}
+	oldManifest, err := readManifest(oldChecksum)
+	if err != nil || oldManifest.Base != "" || oldManifest.Size > maxDeltaInput {
+		return false, err
+	}
+	newManifest, err := readManifest(newChecksum)
+	if err != nil || newManifest.Base != "" || newManifest.Size > maxDeltaInput {
+		return false, err
+	}
+
+	oldContent, err := readManifestContent(oldChecksum)
+	if err != nil {
+		return false, err
+	}
+	newContent, err := readManifestContent(newChecksum)
+	if err != nil {
+		return false, err
+	}
+	delta := encodeDelta(newContent, oldContent)
+	if int64(len(delta))*2 >= oldManifest.Size {
+		return false, nil
+	}
+
+	chunks, _, err := storeChunks(bytes.NewReader(delta), codec)
+	if err != nil {
+		return false, err
+	}
+	err = replaceManifest(oldChecksum, Manifest{Size: oldManifest.Size, Base: newChecksum, Delta: chunks})
+	return err == nil, err
+}
+
+// materialize stores checksum as full content again.
+func materialize(checksum, codec string) error {
+	content, err := readManifestContent(checksum)
+	if err != nil {
+		return err
+	}
+	chunks, size, err := storeChunks(bytes.NewReader(content), codec)
+	if err != nil {
+		return err
+	}
+	return replaceManifest(checksum, Manifest{Size: size, Chunks: chunks})
+}
+
+// deltifyParent turns the content a new version replaces into a delta against
+// it and frees what became unreferenced.
+func deltifyParent(versionDir string, meta VersionMetaData) error {
+	if meta.Parent == "" {
+		return nil
+	}
+	parent, err := FindVersion(versionDir, meta.Parent)
+	if err != nil {
+		return nil
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, pair := range contentPairs(parent, meta) {
+		done, err := deltify(pair[0], pair[1], config.Compression)
+		if err != nil {
+			return err
+		}
+		changed = changed || done
+	}
+	if changed {
+		return collectGarbage()
+	}
+	return nil
+}
+
+// contentPairs lists the (old, new) checksums a version changed compared to
+// its parent: the file itself, or every file of a snapshot by path.
+func contentPairs(parent, child VersionMetaData) [][2]string {
+	if !parent.IsDir && !child.IsDir {
+		return [][2]string{{parent.Checksum, child.Checksum}}
+	}
+	if !parent.IsDir || !child.IsDir {
+		return nil
+	}
+	newFiles := make(map[string]string)
+	for _, entry := range child.Tree {
+		if entry.Checksum != "" {
+			newFiles[entry.Path] = entry.Checksum
+		}
+	}
+	var pairs [][2]string
+	for _, entry := range parent.Tree {
+		if newChecksum, ok := newFiles[entry.Path]; ok && entry.Checksum != "" && entry.Checksum != newChecksum {
+			pairs = append(pairs, [2]string{entry.Checksum, newChecksum})
+		}
+	}
+	return pairs
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func storeSize(godexDir string) (int64, error) {
+	var total int64
+	for _, kind := range []string{"objects", "manifests"} {
+		err := walkObjects(filepath.Join(godexDir, kind), func(hash, path string) error {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// Repack rebuilds the delta chains of the whole store. Content that is only
+// kept as the base of a delta is stored whole again, every older version is
+// stored as a delta against its child, the newest version of every branch
+// stays whole and no chain is longer than maxChain.
+func Repack(maxChain int) (RepackResult, error) {
+	var result RepackResult
+	err := withLocks("", true, func() error {
+		var err error
+		result, err = repack(maxChain)
+		return err
+	})
+	return result, err
+}
+
+func repack(maxChain int) (RepackResult, error) {
+	var result RepackResult
+	if maxChain < 1 {
+		return result, fmt.Errorf("the maximum chain length must be at least 1")
+	}
+	godexDir, err := getGodexDir()
+	if err != nil {
+		return result, err
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return result, err
+	}
+	histories, err := allHistories()
+	if err != nil {
+		return result, err
+	}
+	if result.SizeBefore, err = storeSize(godexDir); err != nil {
+		return result, err
+	}
+
+	referenced := make(map[string]bool)
+	keepWhole := make(map[string]bool)
+	var pairs [][2]string
+	for _, versions := range histories {
+		parents := parentIDs(versions)
+		byID := make(map[string]VersionMetaData, len(versions))
+		hasChild := make(map[string]bool)
+		for _, meta := range versions {
+			byID[meta.ID] = meta
+			hasChild[parents[meta.ID]] = true
+			referenced[meta.Checksum] = true
+			for _, entry := range meta.Tree {
+				referenced[entry.Checksum] = true
+			}
+		}
+		for _, meta := range versions {
+			if !hasChild[meta.ID] {
+				if !meta.IsDir {
+					keepWhole[meta.Checksum] = true
+				}
+				for _, entry := range meta.Tree {
+					keepWhole[entry.Checksum] = true
+				}
+			}
+			if parent, ok := byID[parents[meta.ID]]; ok {
+				pairs = append(pairs, contentPairs(parent, meta)...)
+			}
+		}
+	}
+
+	// bases no version refers to would otherwise be kept alive by their deltas
+	var manifests []string
+	err = walkManifests(func(checksum string, _ Manifest, err error) error {
+		manifests = append(manifests, checksum)
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+	for _, checksum := range manifests {
+		manifest, err := readManifest(checksum)
+		if err != nil {
+			return result, err
+		}
+		if manifest.Base != "" && referenced[checksum] && (!referenced[manifest.Base] || keepWhole[checksum]) {
+			if err := materialize(checksum, config.Compression); err != nil {
+				return result, err
+			}
+			result.Materialized++
+		}
+	}
+
+	// oldest first, so every delta is made against content that is still whole
+	for _, pair := range pairs {
+		if keepWhole[pair[0]] {
+			continue
+		}
+		done, err := deltify(pair[0], pair[1], config.Compression)
+		if err != nil {
+			return result, err
+		}
+		if done {
+			result.Deltified++
+		}
+	}
+
+	cut, err := limitChains(manifests, maxChain, config.Compression)
+	result.Materialized += cut
+	if err != nil {
+		return result, err
+	}
+
+	if err := collectGarbage(); err != nil {
+		return result, fmt.Errorf("failed to clean up unreferenced chunks: %w", err)
+	}
+	result.SizeAfter, err = storeSize(godexDir)
+	return result, err
+}
+
+// limitChains stores content whole wherever its chain would exceed maxChain,
+// working outwards from the full manifests so each cut shortens the chains
+// behind it.
+func limitChains(manifests []string, maxChain int, codec string) (int, error) {
+	bases := make(map[string]string, len(manifests))
+	for _, checksum := range manifests {
+		manifest, err := readManifest(checksum)
+		if err != nil {
+			continue
+		}
+		bases[checksum] = manifest.Base
+	}
+
+	depths := make(map[string]int, len(bases))
+	var depth func(checksum string, seen int) int
+	depth = func(checksum string, seen int) int {
+		if d, ok := depths[checksum]; ok {
+			return d
+		}
+		base := bases[checksum]
+		if base == "" || seen > maxDeltaChain {
+			return 0
+		}
+		d := depth(base, seen+1) + 1
+		depths[checksum] = d
+		return d
+	}
+	order := make([]string, 0, len(bases))
+	for checksum := range bases {
+		depth(checksum, 0)
+		order = append(order, checksum)
+	}
+	sort.Slice(order, func(i, j int) bool { return depths[order[i]] < depths[order[j]] })
+
+	cut := 0
+	current := make(map[string]int, len(order))
+	for _, checksum := range order {
+		base := bases[checksum]
+		if base == "" {
+			current[checksum] = 0
+			continue
+		}
+		d := current[base] + 1
+		if d > maxChain {
+			if err := materialize(checksum, codec); err != nil {
+				return cut, err
+			}
+			cut++
+			d = 0
+		}
+		current[checksum] = d
+	}
+	return cut, nil
+}
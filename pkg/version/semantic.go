@@ -0,0 +1,293 @@
+package version
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SyntaxJSON = "json"
+	SyntaxYAML = "yaml"
+	SyntaxTOML = "toml"
+)
+
+// DetectSyntax guesses the config syntax of a file from its extension. It
+// returns an empty string when the extension is not a known one.
+func DetectSyntax(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return SyntaxJSON
+	case ".yaml", ".yml":
+		return SyntaxYAML
+	case ".toml":
+		return SyntaxTOML
+	}
+	return ""
+}
+
+func parseStructured(content []byte, syntax string) (interface{}, error) {
+	var value interface{}
+	var err error
+
+	switch syntax {
+	case SyntaxJSON:
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		err = decoder.Decode(&value)
+	case SyntaxYAML:
+		err = yaml.Unmarshal(content, &value)
+	case SyntaxTOML:
+		var table map[string]interface{}
+		err = toml.Unmarshal(content, &table)
+		value = table
+	default:
+		return nil, fmt.Errorf("unsupported syntax %q", syntax)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalizeValue(value), nil
+}
+
+// sniffSyntax picks the first syntax both sides parse as a document (a mapping
+// or a list). Plain text parses as a YAML scalar and is rejected.
+func sniffSyntax(content1, content2 []byte) string {
+	for _, syntax := range []string{SyntaxJSON, SyntaxTOML, SyntaxYAML} {
+		value1, err := parseStructured(content1, syntax)
+		if err != nil || !isDocument(value1) {
+			continue
+		}
+		value2, err := parseStructured(content2, syntax)
+		if err != nil || !isDocument(value2) {
+			continue
+		}
+		return syntax
+	}
+	return ""
+}
+
+func isDocument(value interface{}) bool {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+// normalizeValue makes values decoded by the different parsers comparable:
+// map keys become strings and all numbers become int64 or float64.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeValue(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[fmt.Sprint(key)] = normalizeValue(item)
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeValue(item)
+		}
+		return v
+	case []map[string]interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeValue(item)
+		}
+		return normalized
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+func valuesEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x == y
+		case float64:
+			return float64(x) == y
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return x == float64(y)
+		case float64:
+			return x == y
+		}
+	case string, bool, nil:
+		return a == b
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+var plainKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+func joinKeyPath(parent, key string) string {
+	if !plainKey.MatchString(key) {
+		quoted, _ := json.Marshal(key)
+		return parent + "[" + string(quoted) + "]"
+	}
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func compareStructured(path string, oldValue, newValue interface{}, changes *[]StructuredChange) {
+	oldMap, oldIsMap := oldValue.(map[string]interface{})
+	newMap, newIsMap := newValue.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := make([]string, 0, len(oldMap)+len(newMap))
+		for key := range oldMap {
+			keys = append(keys, key)
+		}
+		for key := range newMap {
+			if _, ok := oldMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			keyPath := joinKeyPath(path, key)
+			oldItem, inOld := oldMap[key]
+			newItem, inNew := newMap[key]
+			switch {
+			case !inNew:
+				*changes = append(*changes, StructuredChange{Path: keyPath, Kind: "removed", Old: oldItem})
+			case !inOld:
+				*changes = append(*changes, StructuredChange{Path: keyPath, Kind: "added", New: newItem})
+			default:
+				compareStructured(keyPath, oldItem, newItem, changes)
+			}
+		}
+		return
+	}
+
+	oldList, oldIsList := oldValue.([]interface{})
+	newList, newIsList := newValue.([]interface{})
+	if oldIsList && newIsList {
+		for i := 0; i < max(len(oldList), len(newList)); i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(newList):
+				*changes = append(*changes, StructuredChange{Path: itemPath, Kind: "removed", Old: oldList[i]})
+			case i >= len(oldList):
+				*changes = append(*changes, StructuredChange{Path: itemPath, Kind: "added", New: newList[i]})
+			default:
+				compareStructured(itemPath, oldList[i], newList[i], changes)
+			}
+		}
+		return
+	}
+
+	if oldIsMap || newIsMap || oldIsList || newIsList || !valuesEqual(oldValue, newValue) {
+		*changes = append(*changes, StructuredChange{Path: path, Kind: "changed", Old: oldValue, New: newValue})
+	}
+}
+
+// diffSemantic parses both sides and reports changes by key path, ignoring
+// formatting and key order.
+func diffSemantic(content1, content2 []byte, syntax string) (DiffResult, error) {
+	result := DiffResult{
+		Identical: true,
+		DiffLines: []LineDiff{},
+		DiffType:  "semantic",
+	}
+
+	if syntax == "" {
+		syntax = sniffSyntax(content1, content2)
+		if syntax == "" {
+			return result, fmt.Errorf("could not detect a JSON, YAML or TOML document to compare")
+		}
+	}
+
+	oldValue, err := parseStructured(content1, syntax)
+	if err != nil {
+		return result, fmt.Errorf("failed to parse first file as %s: %w", syntax, err)
+	}
+	newValue, err := parseStructured(content2, syntax)
+	if err != nil {
+		return result, fmt.Errorf("failed to parse second file as %s: %w", syntax, err)
+	}
+
+	compareStructured("", oldValue, newValue, &result.Changes)
+
+	if len(result.Changes) == 0 {
+		result.Message = "Files are semantically identical"
+		return result, nil
+	}
+	result.Identical = false
+	result.Message = fmt.Sprintf("Found %d changed %s keys", len(result.Changes), syntax)
+	return result, nil
+}
+
+func formatStructuredValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+func renderSemantic(result DiffResult, opts RenderOptions) string {
+	var sb strings.Builder
+	sb.WriteString(opts.paint("--- "+result.OldName, styleHeader) + "\n")
+	sb.WriteString(opts.paint("+++ "+result.NewName, styleHeader) + "\n")
+
+	for _, change := range result.Changes {
+		path := change.Path
+		if path == "" {
+			path = "(root)"
+		}
+		switch change.Kind {
+		case "added":
+			sb.WriteString(opts.paint(fmt.Sprintf("+ %s: %s", path, formatStructuredValue(change.New)), styleInsert) + "\n")
+		case "removed":
+			sb.WriteString(opts.paint(fmt.Sprintf("- %s: %s", path, formatStructuredValue(change.Old)), styleDelete) + "\n")
+		case "changed":
+			sb.WriteString(fmt.Sprintf("~ %s: %s -> %s\n", path,
+				opts.paint(formatStructuredValue(change.Old), styleDelete),
+				opts.paint(formatStructuredValue(change.New), styleInsert)))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("\n%s\n", result.Message))
+	return sb.String()
+}
@@ -1,55 +1,126 @@
 package version
 
 import (
-	"bufio"
-	"crypto/md5"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
-	"strings"
+
+	bolt "go.etcd.io/bbolt"
 )
 
+var errVersionExists = errors.New("A version already exists")
+
+// CreateFile records a new version of filePath. When versionID was taken by a
+// concurrent create in the meantime the next free ID is used instead.
 func CreateFile(filePath, versionID, message string) (VersionMetaData, error) {
+	return createFile(filePath, versionID, message, false, true)
+}
+
+// CreateAutoVersion records a new version of filePath marked as Auto.
+func CreateAutoVersion(filePath, message string) (VersionMetaData, error) {
+	return createFile(filePath, "", message, true, true)
+}
+
+// createFile creates a version and, when prune is set, applies the retention
+// policy of the file afterwards.
+func createFile(filePath, versionID, message string, auto, prune bool) (VersionMetaData, error) {
 	fileDir, err := GetVersionPath(filePath)
 	if err != nil {
 		return VersionMetaData{}, err
 	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return VersionMetaData{}, err
+	}
+
+	var meta VersionMetaData
+	err = withLocks(fileDir, false, func() error {
+		if _, err := FindVersion(fileDir, versionID); err == nil || versionID == "" {
+			if versionID, err = GenerateVersionID(filePath); err != nil {
+				return err
+			}
+		}
+		meta, err = createVersion(filePath, versionID, message, fileDir, info.IsDir(), auto)
+		return err
+	})
+	if err != nil {
+		return meta, err
+	}
+
+	// garbage collection needs the store to itself. The version is recorded
+	// already, so failing here must not make the create look failed.
+	err = withLocks(fileDir, true, func() error {
+		return afterCreate(fileDir, meta, prune)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	return meta, nil
+}
+
+func createVersion(filePath, versionID, message, fileDir string, isDir, auto bool) (VersionMetaData, error) {
+	if isDir {
+		return createSnapshot(filePath, versionID, message, fileDir, auto)
+	}
+	// a new version is compared with the one the working copy is based on,
+	// which is not the latest one after restoring an older version
 	lastFilePath := ReturnLastFilePath(fileDir)
 	if lastFilePath == "" {
-		return VersionMetaData{}, err
+		return VersionMetaData{}, fmt.Errorf("failed to read the versions of %s", filePath)
+	}
+	if head := readHead(fileDir); head != "" {
+		lastFilePath = filepath.Join(fileDir, head)
 	}
 	isRequired, err := checkDiffs(filePath, lastFilePath)
 	if err != nil {
 		return VersionMetaData{}, err
 	}
+	// a change of mode, owner or extended attributes is worth a version too
+	if !isRequired {
+		if base, err := FindVersion(fileDir, filepath.Base(lastFilePath)); err == nil {
+			attrs, err := readAttrs(filePath)
+			if err != nil {
+				return VersionMetaData{}, err
+			}
+			isRequired = len(attrChanges(base.Attrs, attrs)) > 0
+		}
+	}
+	// a merge is recorded even when it left the content as it was
+	if !isRequired && readMergeHead(fileDir) != "" {
+		isRequired = true
+	}
 	// if a version without change already exists it return an error
 	if isRequired == false {
-		return VersionMetaData{}, errors.New("A version already exists")
+		return VersionMetaData{}, errVersionExists
+	}
+	return saveFile(filePath, versionID, message, fileDir, auto)
+}
+
+// afterCreate turns the content the new version replaces into a delta and
+// applies the retention policy of the file when prune is set.
+func afterCreate(fileDir string, meta VersionMetaData, prune bool) error {
+	if err := deltifyParent(fileDir, meta); err != nil {
+		return fmt.Errorf("version %s was created but storing its parent as a delta failed: %w", meta.ID, err)
+	}
+	if !prune {
+		return nil
+	}
+	if err := applyPolicy(fileDir); err != nil {
+		return fmt.Errorf("version %s was created but the retention policy failed: %w", meta.ID, err)
 	}
-	meta, err := saveFile(filePath, versionID, message, fileDir)
-	return meta, err
+	return nil
 }
 
 // /////////////////////////////////////////////////////////////////////////////////
 // /////////////////////////////////////////////////////////////////////////////////
 func ListAllVersions(fileDir string) (*[]VersionMetaData, error) {
-	metaDataFilePath := filepath.Join(fileDir, "version.json")
-
 	var listAllVersions []VersionMetaData
-
-	data, err := os.ReadFile(metaDataFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf(
-				"No version currently exists of this file",
-			)
-		}
-		return nil, err
-	}
-	err = json.Unmarshal(data, &listAllVersions)
+	err := withIndex(false, func(tx *bolt.Tx) error {
+		var err error
+		listAllVersions, err = loadVersions(tx, fileDir)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -60,183 +131,82 @@ func ListAllVersions(fileDir string) (*[]VersionMetaData, error) {
 // /////////////////////////////////////////////////////////////////////////////////
 
 func FileDiff(path1, path2 string) (DiffResult, error) {
-	result := DiffResult{
-		Identical: true,
-		DiffLines: []LineDiff{},
-	}
-
-	info1, err := os.Stat(path1)
-	if err != nil {
-		return result, fmt.Errorf("error accessing first file: %w", err)
-	}
-
-	_, err = os.Stat(path2)
-	if err != nil {
-		return result, fmt.Errorf("error accessing second file: %w", err)
-	}
-
-	if info1.Size() < 10*1024*1024 {
-		return compareFilesDetailed(path1, path2)
-	}
-
-	checksum1, err := calculateMD5(path1)
-	if err != nil {
-		return result, err
-	}
-
-	checksum2, err := calculateMD5(path2)
-	if err != nil {
-		return result, err
-	}
-
-	if checksum1 != checksum2 {
-		result.Identical = false
-		result.DiffType = "content"
-		result.Message = "Files have different content (detected by checksum)"
-
-		detailedResult, err := compareFilesDetailed(path1, path2)
-		if err != nil {
-			return result, err
-		}
-		result.DiffLines = detailedResult.DiffLines
-		return result, nil
-	}
-
-	result.Message = "Files are identical"
-	return result, nil
+	return FileDiffWithOptions(path1, path2, DefaultDiffOptions())
 }
 
-// calculateMD5 calculates the MD5 checksum of a file
-func calculateMD5(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
-
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+// FileDiffWithOptions compares path1 (the old side) with path2 (the new side).
+// Either path may be a version path as returned by ReturnLastFilePath.
+func FileDiffWithOptions(path1, path2 string, opts DiffOptions) (DiffResult, error) {
+	var result DiffResult
+	err := withLocks("", false, func() error {
+		var err error
+		result, err = fileDiff(path1, path2, opts)
+		return err
+	})
+	return result, err
 }
 
-func compareFilesDetailed(path1, path2 string) (DiffResult, error) {
+func fileDiff(path1, path2 string, opts DiffOptions) (DiffResult, error) {
 	result := DiffResult{
 		Identical: true,
 		DiffLines: []LineDiff{},
 	}
 
-	file1, err := os.Open(path1)
+	content1, err := readContent(path1)
 	if err != nil {
-		return result, err
+		return result, fmt.Errorf("error accessing first file: %w", err)
 	}
-	defer file1.Close()
 
-	file2, err := os.Open(path2)
+	content2, err := readContent(path2)
 	if err != nil {
-		return result, err
+		return result, fmt.Errorf("error accessing second file: %w", err)
 	}
-	defer file2.Close()
-
-	scanner1 := bufio.NewScanner(file1)
-	scanner2 := bufio.NewScanner(file2)
-
-	lineNum := 0
-
-	for {
-		hasLine1 := scanner1.Scan()
-		hasLine2 := scanner2.Scan()
-		lineNum++
 
-		if !hasLine1 && !hasLine2 {
-			break
+	if opts.Semantic {
+		if opts.Syntax == "" {
+			opts.Syntax = DetectSyntax(path1)
 		}
-
-		if hasLine1 != hasLine2 {
-			result.Identical = false
-			result.DiffType = "line"
-
-			line1 := ""
-			line2 := ""
-
-			if hasLine1 {
-				line1 = scanner1.Text()
-			}
-
-			if hasLine2 {
-				line2 = scanner2.Text()
-			}
-
-			result.DiffLines = append(result.DiffLines, LineDiff{
-				LineNumber: lineNum,
-				Line1:      line1,
-				Line2:      line2,
-			})
-
-			continue
-		}
-
-		// Both files have lines at this point, so compare them
-		line1 := scanner1.Text()
-		line2 := scanner2.Text()
-
-		if line1 != line2 {
-			result.Identical = false
-			result.DiffType = "line"
-
-			result.DiffLines = append(result.DiffLines, LineDiff{
-				LineNumber: lineNum,
-				Line1:      line1,
-				Line2:      line2,
-			})
+		if opts.Syntax == "" {
+			opts.Syntax = DetectSyntax(path2)
 		}
+		result, err = diffSemantic(content1, content2, opts.Syntax)
+	} else {
+		result, err = diffContent(content1, content2, opts)
 	}
-
-	// Check for scanner errors
-	if err := scanner1.Err(); err != nil {
-		return result, err
-	}
-	if err := scanner2.Err(); err != nil {
+	if err != nil {
 		return result, err
 	}
+	result.OldName = path1
+	result.NewName = path2
 
-	if !result.Identical {
-		result.Message = fmt.Sprintf("Found %d different lines", len(result.DiffLines))
-	} else {
-		result.Message = "Files are identical"
+	attrs1, err := pathAttrs(path1)
+	if err != nil {
+		return result, fmt.Errorf("error accessing first file: %w", err)
 	}
-
+	attrs2, err := pathAttrs(path2)
+	if err != nil {
+		return result, fmt.Errorf("error accessing second file: %w", err)
+	}
+	result.AttrChanges = attrChanges(attrs1, attrs2)
 	return result, nil
 }
 
 func FormatDiffResult(result DiffResult) string {
-	var sb strings.Builder
-
 	if result.Identical {
-		sb.WriteString("Files are identical\n")
-		return sb.String()
-	}
-
-	sb.WriteString(result.Message + "\n\n")
-
-	if len(result.DiffLines) > 0 {
-		sb.WriteString("Differences found:\n")
-
-		for _, diff := range result.DiffLines {
-			sb.WriteString(fmt.Sprintf("Line %d:\n", diff.LineNumber))
-			sb.WriteString(fmt.Sprintf("  File 1: %s\n", diff.Line1))
-			sb.WriteString(fmt.Sprintf("  File 2: %s\n\n", diff.Line2))
-		}
+		return "Files are identical\n"
 	}
-
-	return sb.String()
+	return FormatUnifiedDiff(result)
 }
 
 // ////////////////////////////////////////////////////////////////////////////////////////////////
 // ////////////////////////////////////////////////////////////////////////////////////////////////
 func ClearAllVersion(dirPath string) error {
+	return withLocks(dirPath, true, func() error {
+		return clearAllVersions(dirPath)
+	})
+}
+
+func clearAllVersions(dirPath string) error {
 	entries, err := os.ReadDir(dirPath)
 	if err != nil {
 		return fmt.Errorf("error reading directory: %w", err)
@@ -249,6 +219,10 @@ func ClearAllVersion(dirPath string) error {
 			fmt.Printf("Skipping subdirectory: %s\n", entry.Name())
 			continue
 		}
+		// the lock is held by this process until it returns
+		if entry.Name() == ".lock" {
+			continue
+		}
 		filePath := filepath.Join(dirPath, entry.Name())
 
 		if err := os.Remove(filePath); err != nil {
@@ -260,25 +234,27 @@ func ClearAllVersion(dirPath string) error {
 		}
 	}
 	fmt.Printf("\nSummary: Deleted %d files with %d errors\n", deletedCount, errorCount)
+	err = withIndex(true, func(tx *bolt.Tx) error {
+		return deleteFile(tx, dirPath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove the versions from the index: %w", err)
+	}
+	if err := collectGarbage(); err != nil {
+		return fmt.Errorf("failed to clean up unreferenced chunks: %w", err)
+	}
 	return nil
 }
 
 // ///////////////////////////////////////////////////////////////////////////////////////////////
 // ///////////////////////////////////////////////////////////////////////////////////////////////
 func ClearVersion(dirPath, versionID string) error {
-	versionPath := filepath.Join(dirPath, versionID)
-
-	if _, err := os.Stat(versionPath); err != nil {
-		if os.IsNotExist(err) {
-			return fmt.Errorf("no file exists with versionID %s", versionID)
-		}
-		return fmt.Errorf("failed to access file %s: %v", versionID, err)
-	}
-
-	if err := os.Remove(versionPath); err != nil {
-		return fmt.Errorf("failed to remove file %s: %v", versionID, err)
-	}
+	return withLocks(dirPath, true, func() error {
+		return clearVersion(dirPath, versionID)
+	})
+}
 
+func clearVersion(dirPath, versionID string) error {
 	allVersions, err := ListAllVersions(dirPath)
 	if err != nil {
 		return fmt.Errorf("failed to list versions: %v", err)
@@ -288,23 +264,77 @@ func ClearVersion(dirPath, versionID string) error {
 		return fmt.Errorf("version list is nil")
 	}
 
-	i := 0
+	exists := false
 	for _, version := range *allVersions {
-		if version.ID != versionID {
-			(*allVersions)[i] = version
-			i++
+		if version.ID == versionID {
+			exists = true
+			break
 		}
 	}
-	*allVersions = (*allVersions)[:i]
+	if !exists {
+		return fmt.Errorf("no file exists with versionID %s", versionID)
+	}
+
+	return removeVersions(dirPath, map[string]bool{versionID: true})
+}
 
-	jsonPath := filepath.Join(dirPath, "version.json")
-	jsonData, err := json.MarshalIndent(*allVersions, "", "  ")
+// removeVersions drops the given versions from the history of a file along
+// with their tags, then frees the content nothing references anymore.
+func removeVersions(dirPath string, ids map[string]bool) error {
+	allVersions, err := ListAllVersions(dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to list versions: %v", err)
+	}
+
+	// versions created before the chunk store keep their content in dirPath
+	for versionID := range ids {
+		versionPath := filepath.Join(dirPath, versionID)
+		if err := os.Remove(versionPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove file %s: %v", versionID, err)
+		}
+	}
+
+	// children of a removed version are attached to its nearest remaining
+	// ancestor so the history stays connected
+	parents := parentIDs(*allVersions)
+	err = withIndex(true, func(tx *bolt.Tx) error {
+		err := updateVersions(tx, dirPath, func(version VersionMetaData) (VersionMetaData, bool) {
+			if ids[version.ID] {
+				return version, false
+			}
+			version.Parent = parents[version.ID]
+			for ids[version.Parent] {
+				version.Parent = parents[version.Parent]
+			}
+			for ids[version.MergeParent] {
+				version.MergeParent = parents[version.MergeParent]
+			}
+			if version.MergeParent == version.Parent {
+				version.MergeParent = ""
+			}
+			return version, true
+		})
+		if err != nil {
+			return err
+		}
+
+		tags, err := loadTags(tx, dirPath)
+		if err != nil {
+			return err
+		}
+		for name, id := range tags {
+			if ids[id] {
+				delete(tags, name)
+			}
+		}
+		return storeTags(tx, dirPath, tags)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal metadata to JSON: %v", err)
+		return fmt.Errorf("failed to update the version index: %v", err)
 	}
 
-	if err := os.WriteFile(jsonPath, jsonData, 0644); err != nil {
-		return fmt.Errorf("failed to write metadata to file %s: %v", jsonPath, err)
+	if err := collectGarbage(); err != nil {
+		return fmt.Errorf("failed to clean up unreferenced chunks: %v", err)
 	}
 
 	return nil
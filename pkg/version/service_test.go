@@ -0,0 +1,38 @@
+package version
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A version that was recorded is reported as created even when applying the
+// retention policy afterwards fails, so it is not created a second time.
+func TestCreateSucceedsWhenPolicyFails(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	filePath := filepath.Join(t.TempDir(), "c.txt")
+	if err := os.WriteFile(filePath, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFile(filePath, "", "one"); err != nil {
+		t.Fatal(err)
+	}
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(versionDir, "policy.json"), []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filePath, []byte("two\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := CreateFile(filePath, "", "two")
+	if err != nil {
+		t.Fatalf("CreateFile failed although the version was recorded: %v", err)
+	}
+	if _, err := FindVersion(versionDir, meta.ID); err != nil {
+		t.Errorf("version %s is not in the history: %v", meta.ID, err)
+	}
+}
@@ -0,0 +1,516 @@
+package version
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A directory snapshot is a single version whose Tree lists every entry below
+// the directory. File contents go to the shared chunk store like any other
+// version, so unchanged files cost nothing from one snapshot to the next.
+
+func createSnapshot(
+	dirPath,
+	versionID,
+	message,
+	versionPathDir string,
+	auto bool,
+) (VersionMetaData, error) {
+	tree, size, err := scanTree(dirPath, true)
+	if err != nil {
+		return VersionMetaData{}, err
+	}
+	checksum := treeChecksum(tree)
+
+	head := readHead(versionPathDir)
+	if last, err := FindVersion(versionPathDir, head); err == nil {
+		if last.IsDir && last.Checksum == checksum {
+			return VersionMetaData{}, errVersionExists
+		}
+	}
+
+	author, host := versionOrigin()
+	metadata := VersionMetaData{
+		ID:        versionID,
+		CreatedAt: time.Now(),
+		Message:   message,
+		Size:      size,
+		Checksum:  checksum,
+		Parent:    head,
+		IsDir:     true,
+		Tree:      tree,
+		Auto:      auto,
+		Author:    author,
+		Host:      host,
+	}
+
+	// all content is stored before the version is recorded, so the snapshot
+	// either shows up complete or not at all
+	if err = saveMetaData(versionPathDir, metadata); err != nil {
+		return VersionMetaData{}, fmt.Errorf("failed to update meta data")
+	}
+
+	if err = updateGlobalIndex(versionID, dirPath); err != nil {
+		return VersionMetaData{}, fmt.Errorf("unable to update version index")
+	}
+
+	if err = writeHead(versionPathDir, versionID); err != nil {
+		return VersionMetaData{}, err
+	}
+
+	return metadata, nil
+}
+
+// scanTree walks dirPath and describes every entry below it. With store set the
+// file contents are written to the chunk store, otherwise they are only hashed.
+func scanTree(dirPath string, store bool) ([]TreeEntry, int64, error) {
+	var tree []TreeEntry
+	var total int64
+
+	err := filepath.WalkDir(dirPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == dirPath {
+			return nil
+		}
+		relPath, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		entry := TreeEntry{
+			Path:    filepath.ToSlash(relPath),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+
+		switch {
+		case info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return fmt.Errorf("failed to read link %s: %w", filePath, err)
+			}
+			entry.Target = target
+		case info.Mode().IsRegular():
+			checksum, size, err := hashTreeFile(filePath, store)
+			if err != nil {
+				return fmt.Errorf("failed to snapshot %s: %w", filePath, err)
+			}
+			entry.Checksum = checksum
+			entry.Size = size
+			total += size
+		default:
+			// sockets, devices and pipes have no content worth keeping
+			return nil
+		}
+
+		tree = append(tree, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return tree, total, nil
+}
+
+func hashTreeFile(filePath string, store bool) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	if store {
+		return storeContent(file)
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// treeChecksum identifies a tree by its paths, modes and contents. Timestamps
+// are left out so touching a file does not count as a change.
+func treeChecksum(tree []TreeEntry) string {
+	hasher := sha256.New()
+	for _, entry := range tree {
+		fmt.Fprintf(hasher, "%o %s %s %s\n", uint32(entry.Mode), entry.Path, entry.Checksum, entry.Target)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func FindVersion(versionDir, versionID string) (VersionMetaData, error) {
+	allVersions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return VersionMetaData{}, err
+	}
+	for _, meta := range *allVersions {
+		if meta.ID == versionID {
+			return meta, nil
+		}
+	}
+	return VersionMetaData{}, fmt.Errorf("version %s does not exist", versionID)
+}
+
+// RestoreTree brings back a directory snapshot into targetDir. When subPath is
+// set only that file or directory of the snapshot is restored. With clean set,
+// entries on disk that are not part of the snapshot are removed.
+func RestoreTree(versionDir, versionID, targetDir, subPath string, clean bool) error {
+	return withLocks(versionDir, false, func() error {
+		return restoreTree(versionDir, versionID, targetDir, subPath, clean)
+	})
+}
+
+func restoreTree(versionDir, versionID, targetDir, subPath string, clean bool) error {
+	metadata, err := FindVersion(versionDir, versionID)
+	if err != nil {
+		return err
+	}
+	if !metadata.IsDir {
+		return fmt.Errorf("version %s is not a directory snapshot", versionID)
+	}
+
+	entries, err := selectTreeEntries(metadata.Tree, subPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+	}
+
+	for _, entry := range entries {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) {
+			return fmt.Errorf("refusing to restore unsafe path %s", entry.Path)
+		}
+		destination := filepath.Join(targetDir, filepath.FromSlash(entry.Path))
+
+		switch {
+		case entry.Mode.IsDir():
+			if err := makeTreeDirs(targetDir, entry.Path); err != nil {
+				return err
+			}
+		case entry.Mode&os.ModeSymlink != 0:
+			if err := makeTreeDirs(targetDir, path.Dir(entry.Path)); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(destination); err != nil {
+				return fmt.Errorf("failed to replace %s: %w", destination, err)
+			}
+			if err := os.Symlink(entry.Target, destination); err != nil {
+				return fmt.Errorf("failed to create link %s: %w", destination, err)
+			}
+		default:
+			if err := makeTreeDirs(targetDir, path.Dir(entry.Path)); err != nil {
+				return err
+			}
+			if err := restoreTreeFile(entry, destination); err != nil {
+				return err
+			}
+		}
+	}
+
+	if clean {
+		if err := removeUntracked(targetDir, subPath, metadata.Tree); err != nil {
+			return err
+		}
+	}
+
+	// writing files bumps the mtime of their directory, so directories are
+	// stamped last and deepest first
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if !entry.Mode.IsDir() {
+			continue
+		}
+		destination := filepath.Join(targetDir, filepath.FromSlash(entry.Path))
+		if info, err := os.Lstat(destination); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := os.Chmod(destination, entry.Mode.Perm()); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", destination, err)
+		}
+		if err := os.Chtimes(destination, entry.ModTime, entry.ModTime); err != nil {
+			return fmt.Errorf("failed to set times of %s: %w", destination, err)
+		}
+	}
+
+	// restoring a single path, or somewhere else, leaves the working copy
+	// where it was
+	if (subPath == "" || subPath == ".") && tracksPath(versionDir, targetDir) {
+		return writeHead(versionDir, versionID)
+	}
+	return nil
+}
+
+func selectTreeEntries(tree []TreeEntry, subPath string) ([]TreeEntry, error) {
+	if subPath == "" || subPath == "." {
+		return tree, nil
+	}
+	subPath = path.Clean(filepath.ToSlash(subPath))
+
+	var selected []TreeEntry
+	for _, entry := range tree {
+		if entry.Path == subPath || strings.HasPrefix(entry.Path, subPath+"/") {
+			selected = append(selected, entry)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("%s is not part of the snapshot", subPath)
+	}
+	return selected, nil
+}
+
+// makeTreeDirs makes every component of relPath below targetDir a real
+// directory. Links and files in the way are replaced, so nothing is restored
+// through a link to somewhere outside targetDir.
+func makeTreeDirs(targetDir, relPath string) error {
+	if relPath == "." || relPath == "" {
+		return nil
+	}
+	dir := targetDir
+	for _, name := range strings.Split(relPath, "/") {
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if err == nil && info.IsDir() {
+			continue
+		}
+		if err == nil {
+			if err := os.Remove(dir); err != nil {
+				return fmt.Errorf("failed to replace %s: %w", dir, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+func restoreTreeFile(entry TreeEntry, destination string) error {
+	source, err := openManifest(entry.Checksum)
+	if err != nil {
+		return fmt.Errorf("failed to open content of %s: %w", entry.Path, err)
+	}
+	defer source.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	_, err = io.Copy(tmp, io.TeeReader(source, hasher))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy contents of %s: %w", entry.Path, err)
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != entry.Checksum {
+		return fmt.Errorf("checksum verification failed for %s: file may be corrupted", entry.Path)
+	}
+
+	if err := os.Chmod(tmp.Name(), entry.Mode.Perm()); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", destination, err)
+	}
+	if err := os.Chtimes(tmp.Name(), entry.ModTime, entry.ModTime); err != nil {
+		return fmt.Errorf("failed to set times of %s: %w", destination, err)
+	}
+	if err := os.RemoveAll(destination); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", destination, err)
+	}
+	return os.Rename(tmp.Name(), destination)
+}
+
+func removeUntracked(targetDir, subPath string, tree []TreeEntry) error {
+	known := make(map[string]bool, len(tree))
+	for _, entry := range tree {
+		known[entry.Path] = true
+	}
+
+	root := targetDir
+	if subPath != "" && subPath != "." {
+		root = filepath.Join(targetDir, filepath.FromSlash(path.Clean(filepath.ToSlash(subPath))))
+	}
+
+	var untracked []string
+	err := filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if filePath == targetDir {
+			return nil
+		}
+		relPath, err := filepath.Rel(targetDir, filePath)
+		if err != nil {
+			return err
+		}
+		if !known[filepath.ToSlash(relPath)] {
+			untracked = append(untracked, filePath)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", targetDir, err)
+	}
+
+	for _, filePath := range untracked {
+		if err := os.RemoveAll(filePath); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", filePath, err)
+		}
+	}
+	return nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func DiffTrees(oldTree, newTree []TreeEntry) TreeDiff {
+	result := TreeDiff{Identical: true}
+
+	oldEntries := make(map[string]TreeEntry, len(oldTree))
+	for _, entry := range oldTree {
+		oldEntries[entry.Path] = entry
+	}
+	newEntries := make(map[string]TreeEntry, len(newTree))
+	for _, entry := range newTree {
+		newEntries[entry.Path] = entry
+	}
+
+	for _, entry := range oldTree {
+		if _, ok := newEntries[entry.Path]; !ok {
+			result.Changes = append(result.Changes, TreeChange{
+				Path:   entry.Path,
+				Status: "removed",
+				Old:    entry,
+			})
+		}
+	}
+
+	for _, entry := range newTree {
+		old, ok := oldEntries[entry.Path]
+		if !ok {
+			result.Changes = append(result.Changes, TreeChange{
+				Path:   entry.Path,
+				Status: "added",
+				New:    entry,
+			})
+			continue
+		}
+		if old.Checksum != entry.Checksum || old.Target != entry.Target ||
+			old.Mode.Type() != entry.Mode.Type() {
+			result.Changes = append(result.Changes, TreeChange{
+				Path:   entry.Path,
+				Status: "modified",
+				Old:    old,
+				New:    entry,
+			})
+		} else if old.Mode != entry.Mode {
+			result.Changes = append(result.Changes, TreeChange{
+				Path:   entry.Path,
+				Status: "mode",
+				Old:    old,
+				New:    entry,
+			})
+		}
+	}
+
+	result.Identical = len(result.Changes) == 0
+	return result
+}
+
+// DiffSnapshot compares snapshot fromID with snapshot toID, or with the
+// working tree at workingDir when toID is empty.
+func DiffSnapshot(versionDir, fromID, toID, workingDir string) (TreeDiff, error) {
+	from, err := FindVersion(versionDir, fromID)
+	if err != nil {
+		return TreeDiff{}, err
+	}
+	if !from.IsDir {
+		return TreeDiff{}, fmt.Errorf("version %s is not a directory snapshot", fromID)
+	}
+
+	var newTree []TreeEntry
+	if toID != "" {
+		to, err := FindVersion(versionDir, toID)
+		if err != nil {
+			return TreeDiff{}, err
+		}
+		if !to.IsDir {
+			return TreeDiff{}, fmt.Errorf("version %s is not a directory snapshot", toID)
+		}
+		newTree = to.Tree
+	} else {
+		newTree, _, err = scanTree(workingDir, false)
+		if err != nil {
+			return TreeDiff{}, err
+		}
+	}
+
+	return DiffTrees(from.Tree, newTree), nil
+}
+
+func DiffDirectories(dir1, dir2 string) (TreeDiff, error) {
+	tree1, _, err := scanTree(dir1, false)
+	if err != nil {
+		return TreeDiff{}, err
+	}
+	tree2, _, err := scanTree(dir2, false)
+	if err != nil {
+		return TreeDiff{}, err
+	}
+	return DiffTrees(tree1, tree2), nil
+}
+
+func PrintTreeDiff(diffRes *TreeDiff) {
+	if diffRes.Identical {
+		fmt.Println("Directories are identical")
+		return
+	}
+
+	for _, change := range diffRes.Changes {
+		switch change.Status {
+		case "added":
+			fmt.Printf("A  %s\n", change.Path)
+		case "removed":
+			fmt.Printf("D  %s\n", change.Path)
+		case "modified":
+			fmt.Printf("M  %s (%d -> %d bytes)\n", change.Path, change.Old.Size, change.New.Size)
+		case "mode":
+			fmt.Printf("T  %s (%s -> %s)\n", change.Path, change.Old.Mode, change.New.Mode)
+		}
+	}
+
+	fmt.Printf("\nTotal changes: %d\n", len(diffRes.Changes))
+}
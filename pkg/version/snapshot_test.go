@@ -0,0 +1,60 @@
+package version
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Restoring a snapshot must not follow links that were put in place of its
+// directories since.
+func TestRestoreTreeReplacesLinkedDirectories(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	snapshotDir := filepath.Join(root, "p2")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(snapshotDir, "d"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(snapshotDir, "d", "x"), []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := CreateFile(snapshotDir, "", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(snapshotDir, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(snapshotDir, "d")); err != nil {
+		t.Fatal(err)
+	}
+	versionDir, err := GetVersionPath(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreTree(versionDir, meta.ID, snapshotDir, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+		t.Errorf("the restore wrote through the link into %s", outside)
+	}
+	info, err := os.Lstat(filepath.Join(snapshotDir, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Errorf("d is still %v, want a directory", info.Mode().Type())
+	}
+	content, err := os.ReadFile(filepath.Join(snapshotDir, "d", "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "x\n" {
+		t.Errorf("restored %q, want %q", content, "x\n")
+	}
+}
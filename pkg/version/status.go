@@ -0,0 +1,194 @@
+package version
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Status compares every tracked file with the version its working copy is
+// based on: HEAD, or the latest version when nothing was restored.
+
+const (
+	StateUnchanged = "unchanged"
+	StateModified  = "modified"
+	StateMissing   = "missing"
+)
+
+type FileStatus struct {
+	Path          string
+	State         string
+	IsDir         bool `json:",omitempty"`
+	Base          string
+	Versions      int
+	Size          int64
+	StoredSize    int64
+	LastUpdatedAt time.Time
+}
+
+// Status reports on every tracked file with at least one version, sorted by
+// path.
+func Status() ([]FileStatus, error) {
+	var statuses []FileStatus
+	err := withLocks("", false, func() error {
+		var err error
+		statuses, err = fileStatuses()
+		return err
+	})
+	return statuses, err
+}
+
+func fileStatuses() ([]FileStatus, error) {
+	tracked, err := TrackedFiles()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []FileStatus
+	for _, index := range tracked {
+		if index.OriginalFilePath == "" || len(index.Versions) == 0 {
+			continue
+		}
+		status, err := fileStatus(index)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Path < statuses[j].Path })
+	return statuses, nil
+}
+
+func fileStatus(index GlobalIndex) (FileStatus, error) {
+	status := FileStatus{
+		Path:          index.OriginalFilePath,
+		Versions:      len(index.Versions),
+		LastUpdatedAt: index.LastUpdatedAt,
+	}
+	versionDir, err := GetVersionPath(index.OriginalFilePath)
+	if err != nil {
+		return status, err
+	}
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return status, err
+	}
+	base := (*versions)[len(*versions)-1]
+	if head, err := FindVersion(versionDir, readHead(versionDir)); err == nil {
+		base = head
+	}
+	status.Base = base.ID
+	status.IsDir = base.IsDir
+	for _, meta := range *versions {
+		status.Size += meta.Size
+	}
+	if status.StoredSize, err = storedSize(versionDir, *versions); err != nil {
+		return status, err
+	}
+	status.State, err = workingState(index.OriginalFilePath, base)
+	return status, err
+}
+
+// workingState tells whether path still holds the content of meta.
+func workingState(path string, meta VersionMetaData) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return StateMissing, nil
+		}
+		return "", err
+	}
+	if info.IsDir() != meta.IsDir {
+		return StateModified, nil
+	}
+	if !meta.IsDir && info.Size() != meta.Size {
+		return StateModified, nil
+	}
+	checksum, err := pathChecksum(path, meta.IsDir)
+	if err != nil {
+		return "", err
+	}
+	if checksum != meta.Checksum {
+		return StateModified, nil
+	}
+	if !meta.IsDir && meta.Attrs != nil {
+		attrs, err := readAttrs(path)
+		if err != nil {
+			return "", err
+		}
+		if len(attrChanges(meta.Attrs, attrs)) > 0 {
+			return StateModified, nil
+		}
+	}
+	return StateUnchanged, nil
+}
+
+// storedSize adds up the manifests, chunks and legacy copies the versions of a
+// file need, counting each once. Content shared with other files is counted
+// for each of them.
+func storedSize(versionDir string, versions []VersionMetaData) (int64, error) {
+	var total int64
+	addFile := func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	}
+
+	manifests := make(map[string]bool)
+	var pending []string
+	for _, meta := range versions {
+		if err := addFile(filepath.Join(versionDir, meta.ID)); err != nil {
+			return 0, err
+		}
+		for _, checksum := range contentRefs(meta) {
+			if !manifests[checksum] {
+				manifests[checksum] = true
+				pending = append(pending, checksum)
+			}
+		}
+	}
+
+	chunks := make(map[string]bool)
+	for len(pending) > 0 {
+		checksum := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		manifest, err := readManifest(checksum)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return 0, err
+		}
+		path, err := objectPath("manifests", checksum)
+		if err != nil {
+			return 0, err
+		}
+		if err := addFile(path); err != nil {
+			return 0, err
+		}
+		for _, chunk := range append(manifest.Chunks, manifest.Delta...) {
+			chunks[chunk] = true
+		}
+		if manifest.Base != "" && !manifests[manifest.Base] {
+			manifests[manifest.Base] = true
+			pending = append(pending, manifest.Base)
+		}
+	}
+	for chunk := range chunks {
+		path, err := objectPath("objects", chunk)
+		if err != nil {
+			return 0, err
+		}
+		if err := addFile(path); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
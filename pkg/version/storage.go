@@ -1,15 +1,16 @@
 package version
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 // //////////////////////////////////////////////////////////////////////////////////////////////
@@ -19,38 +20,36 @@ func saveFile(
 	versionID,
 	message,
 	versionPathDir string,
+	auto bool,
 ) (VersionMetaData, error) {
-	versionFilePath := filepath.Join(versionPathDir, versionID)
-
 	sourceFile, err := os.Open(filePath)
 	if err != nil {
 		return VersionMetaData{}, fmt.Errorf("failed to open source file")
 	}
 	defer sourceFile.Close()
 
-	destinationFile, err := os.Create(versionFilePath)
+	checksum, size, err := storeContent(sourceFile)
 	if err != nil {
-		return VersionMetaData{}, fmt.Errorf("failed to create version file")
+		return VersionMetaData{}, fmt.Errorf("failed to store file content: %w", err)
 	}
-	defer destinationFile.Close()
-
-	hasher := sha256.New()
-
-	tee := io.TeeReader(sourceFile, hasher)
-
-	size, err := io.Copy(destinationFile, tee)
+	attrs, err := readAttrs(filePath)
 	if err != nil {
-		return VersionMetaData{}, fmt.Errorf("failed to copy file")
+		return VersionMetaData{}, err
 	}
 
-	checksum := hex.EncodeToString(hasher.Sum(nil))
-
+	author, host := versionOrigin()
 	metadata := VersionMetaData{
-		ID:        versionID,
-		CreatedAt: time.Now(),
-		Message:   message,
-		Size:      int64(size),
-		Checksum:  checksum,
+		ID:          versionID,
+		CreatedAt:   time.Now(),
+		Message:     message,
+		Size:        int64(size),
+		Checksum:    checksum,
+		Parent:      readHead(versionPathDir),
+		MergeParent: readMergeHead(versionPathDir),
+		Attrs:       attrs,
+		Auto:        auto,
+		Author:      author,
+		Host:        host,
 	}
 
 	if err = saveMetaData(versionPathDir, metadata); err != nil {
@@ -61,178 +60,200 @@ func saveFile(
 		return VersionMetaData{}, fmt.Errorf("unable to update version index")
 	}
 
+	if err = writeHead(versionPathDir, versionID); err != nil {
+		return VersionMetaData{}, err
+	}
+	if err = clearMergeHead(versionPathDir); err != nil {
+		return VersionMetaData{}, err
+	}
+
 	return metadata, nil
 }
 
 // //////////////////////////////////////////////////////////////////////////////////////
 // //////////////////////////////////////////////////////////////////////////////////////
 
-func saveMetaData(filePath string, metadata VersionMetaData) error {
-	fullPath := filepath.Join(filePath, "version.json")
-	var metadataEntries []VersionMetaData
-
-	if _, err := os.Stat(fullPath); err == nil {
-		fileData, err := os.ReadFile(fullPath)
-		if err != nil {
-			return fmt.Errorf("failed to read existing metadata file")
-		}
-
-		// Unmarshal existing data
-		if err := json.Unmarshal(fileData, &metadataEntries); err != nil {
-			var singleMetadata VersionMetaData
-			if err := json.Unmarshal(fileData, &singleMetadata); err != nil {
-				return fmt.Errorf("failed to parse existing metadata")
-			}
-			metadataEntries = append(metadataEntries, singleMetadata)
-		}
-		metadataEntries = append(metadataEntries, metadata)
-	} else {
-		// File doesnt exist start with just the new metadata
-		metadataEntries = []VersionMetaData{metadata}
-	}
-
-	jsonData, err := json.MarshalIndent(metadataEntries, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal metadata to JSON")
-	}
-
-	if err := os.WriteFile(fullPath, jsonData, 0644); err != nil {
-		return fmt.Errorf("failed to write metadata to file %s", fullPath)
-	}
-
-	return nil
+func saveMetaData(versionDir string, metadata VersionMetaData) error {
+	return withIndex(true, func(tx *bolt.Tx) error {
+		return appendVersion(tx, versionDir, metadata)
+	})
 }
 
 ///////////////////////////////////////////////////////////////////////////////////
 ///////////////////////////////////////////////////////////////////////////////////
 
+// updateGlobalIndex records where the file of versionID lives and when it last
+// got a version.
 func updateGlobalIndex(versionID, filePath string) error {
-	homeDir, err := os.UserHomeDir()
+	versionDir, err := GetVersionPath(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to get home directory")
-	}
-
-	dirPath := filepath.Join(homeDir, ".config", "godex")
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		return fmt.Errorf("failed to create directory %s", dirPath)
+		return err
 	}
+	return withIndex(true, func(tx *bolt.Tx) error {
+		return recordFile(tx, versionDir, filePath, time.Now())
+	})
+}
 
-	globalIndexPath := filepath.Join(dirPath, "global.json")
-	indexMap := make(map[string]*GlobalIndex)
-
-	if _, err := os.Stat(globalIndexPath); err == nil {
-		fileData, err := os.ReadFile(globalIndexPath)
-		if err != nil {
-			return fmt.Errorf("failed to read global index file")
-		}
+/////////////////////////////////////////////////////////////////////////////////
+/////////////////////////////////////////////////////////////////////////////////
 
-		var indices []GlobalIndex
-		if err := json.Unmarshal(fileData, &indices); err != nil {
-			var singleIndex GlobalIndex
-			if err := json.Unmarshal(fileData, &singleIndex); err != nil {
-				return fmt.Errorf("failed to parse global index")
-			}
-			indices = []GlobalIndex{singleIndex}
-		}
+func RestoreFile(filePath, versionID, originalFilePath string) error {
+	return withLocks(filePath, false, func() error {
+		return restoreFile(filePath, versionID, originalFilePath)
+	})
+}
 
-		for i := range indices {
-			indexMap[indices[i].OriginalFilePath] = &indices[i]
-		}
+func restoreFile(filePath, versionID, originalFilePath string) error {
+	metadata, err := FindVersion(filePath, versionID)
+	if err != nil {
+		return err
 	}
-
-	now := time.Now()
-	if idx, exists := indexMap[filePath]; exists {
-		versionExists := false
-		for _, v := range idx.Versions {
-			if v == versionID {
-				versionExists = true
-				break
-			}
-		}
-
-		if !versionExists {
-			idx.Versions = append(idx.Versions, versionID)
-		}
-		idx.LastUpdatedAt = now
-	} else {
-		indexMap[filePath] = &GlobalIndex{
-			OriginalFilePath: filePath,
-			Versions:         []string{versionID},
-			LastUpdatedAt:    now,
-		}
+	if metadata.IsDir {
+		return fmt.Errorf("version %s is a directory snapshot", versionID)
 	}
 
-	var updatedIndices []GlobalIndex
-	for _, idx := range indexMap {
-		updatedIndices = append(updatedIndices, *idx)
+	// only touch the original once the stored content is known to be intact
+	if err := verifyContent(metadata.Checksum, func() (io.ReadCloser, error) {
+		return openVersion(filePath, versionID)
+	}); err != nil {
+		return err
 	}
-
-	jsonData, err := json.MarshalIndent(updatedIndices, "", "  ")
+	sourceFile, err := openVersion(filePath, versionID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal global index to JSON")
+		return fmt.Errorf("failed to open version file: %w", err)
 	}
+	defer sourceFile.Close()
 
-	if err := os.WriteFile(globalIndexPath, jsonData, 0644); err != nil {
-		return fmt.Errorf("failed to write global index to file")
+	destinationFile, err := os.Create(originalFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
 	}
-
-	return nil
-}
-
-/////////////////////////////////////////////////////////////////////////////////
-/////////////////////////////////////////////////////////////////////////////////
-
-func RestoreFile(filePath, versionID, originalFilePath string) error {
-	versionFilePath := filepath.Join(filePath, versionID)
-
-	if _, err := os.Stat(versionFilePath); os.IsNotExist(err) {
-		return fmt.Errorf("version %s does not exist", versionID)
+	_, err = io.Copy(destinationFile, sourceFile)
+	if closeErr := destinationFile.Close(); err == nil {
+		err = closeErr
 	}
-	allVersionMetaData, err := ListAllVersions(filePath)
 	if err != nil {
+		return fmt.Errorf("failed to copy file contents: %w", err)
+	}
+	if err := applyAttrs(originalFilePath, metadata.Attrs); err != nil {
 		return err
 	}
-	var metadata VersionMetaData
-	for _, fileMetaData := range *allVersionMetaData {
-		if fileMetaData.ID == versionID {
-			metadata = fileMetaData
-			break
-		}
+
+	// restoring somewhere else leaves the working copy where it was
+	if !tracksPath(filePath, originalFilePath) {
+		return nil
+	}
+	// restoring gives up a merge that was not recorded in a version
+	if err := clearMergeHead(filePath); err != nil {
+		return err
 	}
-	sourceFile, err := os.Open(versionFilePath)
+	return writeHead(filePath, versionID)
+}
+
+// verifyContent reads what open returns and checks it against checksum.
+func verifyContent(checksum string, open func() (io.ReadCloser, error)) error {
+	sourceFile, err := open()
 	if err != nil {
 		return fmt.Errorf("failed to open version file: %w", err)
 	}
 	defer sourceFile.Close()
 
 	hasher := sha256.New()
-	sourceReader := io.TeeReader(sourceFile, hasher)
-
-	var buffer bytes.Buffer
-	_, err = io.Copy(&buffer, sourceReader)
+	_, err = io.Copy(hasher, sourceFile)
 	if err != nil {
 		return fmt.Errorf("failed to read version file: %w", err)
 	}
 
 	actualChecksum := hex.EncodeToString(hasher.Sum(nil))
-	if actualChecksum != metadata.Checksum {
+	if actualChecksum != checksum {
 		return fmt.Errorf("checksum verification failed: file may be corrupted")
 	}
+	return nil
+}
 
-	if _, err = sourceFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("failed to reset file pointer: %w", err)
-	}
+// tracksPath tells whether versionDir holds the history of path.
+func tracksPath(versionDir, path string) bool {
+	hash := sha256.Sum256([]byte(path))
+	return filepath.Base(versionDir) == hex.EncodeToString(hash[:])
+}
 
-	destinationFile, err := os.Create(originalFilePath)
+// ////////////////////////////////////////////////////////////////////////////
+// ////////////////////////////////////////////////////////////////////////////
+
+// WriteVersion writes the content of a version to w after verifying it. For a
+// directory snapshot subPath names the file of the snapshot to write.
+func WriteVersion(versionDir, versionID, subPath string, w io.Writer) error {
+	return withLocks("", false, func() error {
+		return writeVersion(versionDir, versionID, subPath, w)
+	})
+}
+
+func writeVersion(versionDir, versionID, subPath string, w io.Writer) error {
+	metadata, err := FindVersion(versionDir, versionID)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
+		return err
 	}
-	defer destinationFile.Close()
 
-	_, err = io.Copy(destinationFile, sourceFile)
-	if err != nil {
-		return fmt.Errorf("failed to copy file contents: %w", err)
+	checksum := metadata.Checksum
+	open := func() (io.ReadCloser, error) {
+		return openVersion(versionDir, versionID)
+	}
+	if metadata.IsDir {
+		if subPath == "" {
+			return fmt.Errorf("version %s is a directory snapshot, choose one of its files with --path", versionID)
+		}
+		subPath = path.Clean(filepath.ToSlash(subPath))
+		var entry *TreeEntry
+		for i := range metadata.Tree {
+			if metadata.Tree[i].Path == subPath {
+				entry = &metadata.Tree[i]
+			}
+		}
+		if entry == nil || !entry.Mode.IsRegular() {
+			return fmt.Errorf("%s is not a file of the snapshot", subPath)
+		}
+		checksum = entry.Checksum
+		open = func() (io.ReadCloser, error) {
+			return openManifest(entry.Checksum)
+		}
+	} else if subPath != "" {
+		return fmt.Errorf("--path can only be used with directory snapshots")
 	}
 
+	if err := verifyContent(checksum, open); err != nil {
+		return err
+	}
+	sourceFile, err := open()
+	if err != nil {
+		return fmt.Errorf("failed to open version file: %w", err)
+	}
+	defer sourceFile.Close()
+	if _, err := io.Copy(w, sourceFile); err != nil {
+		return fmt.Errorf("failed to write version %s: %w", versionID, err)
+	}
 	return nil
 }
+
+// SaveWorkingCopy creates a version of filePath when it was changed since the
+// version it is based on, so a restore does not lose those changes. It
+// returns false when there was nothing to save. The retention policy is not
+// applied, as it could remove the version about to be restored.
+func SaveWorkingCopy(filePath, message string) (VersionMetaData, bool, error) {
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		return VersionMetaData{}, false, err
+	}
+	base, err := FindVersion(versionDir, readHead(versionDir))
+	if err != nil {
+		return VersionMetaData{}, false, err
+	}
+	state, err := workingState(filePath, base)
+	if err != nil || state != StateModified {
+		return VersionMetaData{}, false, err
+	}
+	meta, err := createFile(filePath, "", message, false, false)
+	if err != nil {
+		return meta, false, err
+	}
+	return meta, true, nil
+}
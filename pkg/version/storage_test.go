@@ -0,0 +1,54 @@
+package version
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Saving the working copy before a restore must not let the retention policy
+// remove the version being restored.
+func TestSaveWorkingCopyKeepsRestoreTarget(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	filePath := filepath.Join(t.TempDir(), "p.txt")
+	for _, content := range []string{"one\n", "two\n"} {
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CreateFile(filePath, "", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versionDir, err := GetVersionPath(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keeps only the newest version of today besides HEAD
+	if err := SavePolicy(versionDir, RetentionPolicy{KeepDaily: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filePath, []byte("three\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved, ok, err := SaveWorkingCopy(filePath, "before restoring v1")
+	if err != nil || !ok {
+		t.Fatalf("SaveWorkingCopy = %v, %v", ok, err)
+	}
+	for _, id := range []string{"v1", "v2", saved.ID} {
+		if _, err := FindVersion(versionDir, id); err != nil {
+			t.Errorf("version %s is gone after saving the working copy: %v", id, err)
+		}
+	}
+
+	if err := RestoreFile(versionDir, "v1", filePath); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "one\n" {
+		t.Errorf("restored %q, want %q", content, "one\n")
+	}
+}
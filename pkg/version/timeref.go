@@ -0,0 +1,91 @@
+package version
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Versions can be picked by time instead of ID: the version a file had at a
+// point in time is the newest one created at or before it.
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// ParseTime parses an absolute time like "2026-10-01 14:00", a time of day
+// like "14:00" (today), "now", "today", "yesterday", or an age like 3h or 2d
+// meaning that long before now. Times without a zone are local.
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch strings.ToLower(value) {
+	case "now":
+		return now, nil
+	case "today":
+		return midnight, nil
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return midnight.Add(time.Duration(t.Hour())*time.Hour +
+				time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second), nil
+		}
+	}
+	if age, err := ParseAge(value); err == nil {
+		return now.Add(-age), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use e.g. \"2026-10-01 14:00\", 14:00, yesterday or 3h", value)
+}
+
+// VersionAt returns the version the file had at t.
+func VersionAt(versionDir string, t time.Time) (VersionMetaData, error) {
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return VersionMetaData{}, err
+	}
+	var found VersionMetaData
+	for _, meta := range *versions {
+		if !meta.CreatedAt.After(t) && (found.ID == "" || meta.CreatedAt.After(found.CreatedAt)) {
+			found = meta
+		}
+	}
+	if found.ID == "" {
+		return found, fmt.Errorf("no version existed at %s", t.Format("2006-01-02 15:04:05"))
+	}
+	return found, nil
+}
+
+// VersionSince returns the version a range starting at t begins with: the
+// version the file had at t, or the first one created after it when the file
+// had none yet.
+func VersionSince(versionDir string, t time.Time) (VersionMetaData, error) {
+	if meta, err := VersionAt(versionDir, t); err == nil {
+		return meta, nil
+	}
+	versions, err := ListAllVersions(versionDir)
+	if err != nil {
+		return VersionMetaData{}, err
+	}
+	var found VersionMetaData
+	for _, meta := range *versions {
+		if found.ID == "" || meta.CreatedAt.Before(found.CreatedAt) {
+			found = meta
+		}
+	}
+	if found.ID == "" {
+		return found, errNoVersions
+	}
+	return found, nil
+}
@@ -1,6 +1,9 @@
 package version
 
-import "time"
+import (
+	"os"
+	"time"
+)
 
 type VersionMetaData struct {
 	ID        string
@@ -8,6 +11,41 @@ type VersionMetaData struct {
 	Size      int64
 	Checksum  string
 	CreatedAt time.Time
+	Parent    string `json:",omitempty"`
+	// MergeParent is the version merged into the working copy before this
+	// version was created, see MergeFile
+	MergeParent string      `json:",omitempty"`
+	IsDir       bool        `json:",omitempty"`
+	Tree        []TreeEntry `json:",omitempty"`
+	Attrs       *FileAttrs  `json:",omitempty"`
+	// Auto is set on versions nobody asked for, like the ones godex watch
+	// creates, so retention policies can treat them differently.
+	Auto bool `json:",omitempty"`
+	// who created the version where, and labels added by version annotate
+	Author string            `json:",omitempty"`
+	Host   string            `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+}
+
+// FileAttrs is the metadata of a file version besides its content. UID and
+// GID are -1 where the platform has no numeric owners.
+type FileAttrs struct {
+	Mode    os.FileMode
+	UID     int
+	GID     int
+	ModTime time.Time
+	Xattrs  map[string][]byte `json:",omitempty"`
+}
+
+// TreeEntry describes one path of a directory snapshot, relative to the
+// snapshot root and always slash separated.
+type TreeEntry struct {
+	Path     string
+	Mode     os.FileMode
+	ModTime  time.Time
+	Size     int64
+	Checksum string `json:",omitempty"`
+	Target   string `json:",omitempty"`
 }
 
 type GlobalIndex struct {
@@ -20,7 +58,63 @@ type DiffResult struct {
 	Identical bool
 	DiffType  string
 	Message   string
+	OldName   string
+	NewName   string
 	DiffLines []LineDiff
+	Hunks     []DiffHunk
+	// set for binary content, see diffBinary
+	OldSize    int64         `json:",omitempty"`
+	NewSize    int64         `json:",omitempty"`
+	ByteRanges []ByteRange   `json:",omitempty"`
+	Entries    []EntryChange `json:",omitempty"`
+	// set by the semantic mode, see diffSemantic
+	Changes []StructuredChange `json:",omitempty"`
+	// mode, owner and extended attribute changes, see attrChanges
+	AttrChanges []string `json:",omitempty"`
+}
+
+// StructuredChange is one difference between two parsed config documents.
+// Kind is "added", "removed" or "changed" and Path is the key path, for
+// example spec.containers[0].image.
+type StructuredChange struct {
+	Path string
+	Kind string
+	Old  interface{} `json:",omitempty"`
+	New  interface{} `json:",omitempty"`
+}
+
+type ByteRange struct {
+	OldOffset int64
+	OldLength int64
+	NewOffset int64
+	NewLength int64
+	OldBytes  []byte `json:",omitempty"`
+	NewBytes  []byte `json:",omitempty"`
+}
+
+// EntryChange is a member of a zip or tar archive that differs between the
+// two sides of a diff.
+type EntryChange struct {
+	Name    string
+	Status  string
+	OldSize int64
+	NewSize int64
+}
+
+type DiffHunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []DiffLine
+}
+
+type DiffLine struct {
+	Op        LineOp
+	Text      string
+	OldLine   int
+	NewLine   int
+	NoNewline bool
 }
 
 type LineDiff struct {
@@ -28,3 +122,35 @@ type LineDiff struct {
 	Line1      string
 	Line2      string
 }
+
+type Manifest struct {
+	// Checksum is the checksum of the content, which the name of the manifest
+	// does not give away in an encrypted store
+	Checksum string `json:",omitempty"`
+	Size     int64
+	Chunks   []string
+	// Base and Delta are set instead of Chunks for content stored as a delta
+	// against the content with checksum Base.
+	Base  string   `json:",omitempty"`
+	Delta []string `json:",omitempty"`
+}
+
+type TreeDiff struct {
+	Identical bool
+	Changes   []TreeChange
+}
+
+type TreeChange struct {
+	Path   string
+	Status string
+	Old    TreeEntry
+	New    TreeEntry
+}
+
+type MergeResult struct {
+	Base      string
+	Head      string
+	Theirs    string
+	Conflicts int
+	UpToDate  bool
+}
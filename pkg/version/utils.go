@@ -1,15 +1,14 @@
 package version
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
-
-	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
 // ///////////////////////////////////////////////////////
@@ -42,37 +41,23 @@ func GenerateVersionID(filePath string) (string, error) {
 		return "", err
 	}
 
-	versionFilePath := filepath.Join(dirPath, "version.json")
-
 	nextVersion := 1
 
-	if _, err := os.Stat(versionFilePath); err == nil {
-		fileData, err := os.ReadFile(versionFilePath)
-		if err != nil {
-			return "", fmt.Errorf("failed to read version file: %w", err)
-		}
-
-		var versions []VersionMetaData
-		if err := json.Unmarshal(fileData, &versions); err != nil {
-			var singleVersion VersionMetaData
-			if err := json.Unmarshal(fileData, &singleVersion); err != nil {
-				return "", fmt.Errorf("failed to parse version data: %w", err)
-			}
-			versions = []VersionMetaData{singleVersion}
-		}
-
-		if len(versions) > 0 {
-			highestVersion := 0
-			for _, version := range versions {
-				if len(version.ID) > 1 && version.ID[0] == 'v' {
-					vNum, err := strconv.Atoi(version.ID[1:])
-					if err == nil && vNum > highestVersion {
-						highestVersion = vNum
-					}
+	versions, err := ListAllVersions(dirPath)
+	if err != nil && !errors.Is(err, errNoVersions) {
+		return "", fmt.Errorf("failed to read version file: %w", err)
+	}
+	if err == nil {
+		highestVersion := 0
+		for _, version := range *versions {
+			if len(version.ID) > 1 && version.ID[0] == 'v' {
+				vNum, err := strconv.Atoi(version.ID[1:])
+				if err == nil && vNum > highestVersion {
+					highestVersion = vNum
 				}
 			}
-			nextVersion = highestVersion + 1
 		}
+		nextVersion = highestVersion + 1
 	}
 
 	versionID := fmt.Sprintf("v%d", nextVersion)
@@ -91,41 +76,31 @@ func checkDiffs(filePath1, filePath2 string) (bool, error) {
 		return false, fmt.Errorf("Error reading the file1 %w", err)
 	}
 
-	content2, err := os.ReadFile(filepath.Clean(filePath2))
+	content2, err := readContent(filepath.Clean(filePath2))
 	if err != nil {
 		return false, fmt.Errorf("Error reading the file2 %w", err)
 	}
 
-	dmp := diffmatchpatch.New()
-
-	diffs := dmp.DiffMain(string(content1), string(content2), false)
-
-	return !(len(diffs) == 1 && diffs[0].Type == diffmatchpatch.DiffEqual), nil
+	// a byte comparison is all that is needed here and, unlike a character
+	// diff, stays cheap for large binary files
+	return !bytes.Equal(content1, content2), nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 ///////////////////////////////////////////////////////////////////////////////
 
 func ReturnLastFilePath(jsonDirPath string) string {
-	filePath := filepath.Join(jsonDirPath, "version.json")
-	var elements []VersionMetaData
-
-	if _, err := os.Stat(filePath); err != nil {
-		if os.IsNotExist(err) {
+	elements, err := ListAllVersions(jsonDirPath)
+	if err != nil {
+		if errors.Is(err, errNoVersions) {
 			return "No file found"
 		}
 		return ""
 	}
-	file, err := os.ReadFile(filePath)
-	if err != nil {
-		return ""
-	}
-	err = json.Unmarshal(file, &elements)
-	if err != nil {
-		return ""
+	if len(*elements) == 0 {
+		return "No file found"
 	}
-	num := len(elements)
-	filename := fmt.Sprintf("v%d", num)
+	filename := (*elements)[len(*elements)-1].ID
 	returnPath := filepath.Join(jsonDirPath, filename)
 	return returnPath
 }
@@ -133,64 +108,51 @@ func ReturnLastFilePath(jsonDirPath string) string {
 // //////////////////////////////////////////////////////////////////////////////
 // //////////////////////////////////////////////////////////////////////////////
 func PrintDiffResults(diffRes *DiffResult) {
-	if diffRes.Identical {
-		fmt.Println("Files are identical")
-		return
+	if err := PrintDiffResultsWithOptions(diffRes, DefaultRenderOptions()); err != nil {
+		fmt.Println(err)
 	}
+}
 
-	fmt.Printf("Diff Type: %s\n", diffRes.DiffType)
-
-	if diffRes.Message != "" {
-		fmt.Printf("Message: %s\n", diffRes.Message)
+func PrintDiffResultsWithOptions(diffRes *DiffResult, opts RenderOptions) error {
+	for _, change := range diffRes.AttrChanges {
+		fmt.Println(change)
 	}
-
-	if len(diffRes.DiffLines) == 0 {
-		fmt.Println("No line differences found")
-		return
+	if diffRes.Identical && len(diffRes.AttrChanges) > 0 {
+		fmt.Println("Contents are identical")
+		return nil
 	}
-
-	fmt.Println("\nDifferences:")
-	fmt.Println("-------------------------------------------")
-
-	for _, diff := range diffRes.DiffLines {
-		fmt.Printf("Line %d:\n", diff.LineNumber)
-		if diff.Line1 == "" {
-			fmt.Printf("+ %s\n", diff.Line2)
-		} else if diff.Line2 == "" {
-			fmt.Printf("- %s\n", diff.Line1)
+	if diffRes.Identical {
+		if diffRes.Message != "" {
+			fmt.Println(diffRes.Message)
 		} else {
-			fmt.Printf("- %s\n+ %s\n", diff.Line1, diff.Line2)
+			fmt.Println("Files are identical")
 		}
-		fmt.Println("-------------------------------------------")
+		return nil
 	}
 
-	fmt.Printf("\nTotal differences: %d\n", len(diffRes.DiffLines))
+	output, err := RenderDiff(*diffRes, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Print(output)
+	return nil
 }
 
 ////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////
 
 func ReturnLastSecondFilePath(jsonDirPath string) string {
-	filePath := filepath.Join(jsonDirPath, "version.json")
-	var elements []VersionMetaData
-	if _, err := os.Stat(filePath); err != nil {
-		if os.IsNotExist(err) {
+	elements, err := ListAllVersions(jsonDirPath)
+	if err != nil {
+		if errors.Is(err, errNoVersions) {
 			return "No file found"
 		}
 		return ""
 	}
-	file, err := os.ReadFile(filePath)
-	if err != nil {
-		return ""
-	}
-	err = json.Unmarshal(file, &elements)
-	if err != nil {
-		return ""
-	}
-	if len(elements) < 2 {
+	if len(*elements) < 2 {
 		return "No previous version found to check"
 	}
-	secondLastVersionData := elements[len(elements)-2]
+	secondLastVersionData := (*elements)[len(*elements)-2]
 	filename := secondLastVersionData.ID
 	returnPath := filepath.Join(jsonDirPath, filename)
 	return returnPath
@@ -0,0 +1,289 @@
+package version
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch creates versions of files as they are saved. Editors write a file in
+// several steps, so a version is only created once a file has been quiet for
+// the debounce window, and at most once per minimum interval. Files given by
+// name are always watched; files found under a watched directory have to pass
+// the include and exclude globs. Globs match the base name or the path
+// relative to the watched directory.
+
+// DefaultWatchExcludes skips hidden files and directories and the backup and
+// probe files editors write next to the file being saved.
+var DefaultWatchExcludes = []string{".*", "*~", "*.tmp", "4913"}
+
+type WatchOptions struct {
+	Debounce    time.Duration
+	MinInterval time.Duration
+	Include     []string
+	Exclude     []string
+	Message     string
+}
+
+// WatchEvent reports a version created by Watch, or an error that did not stop
+// it.
+type WatchEvent struct {
+	Path    string
+	Version VersionMetaData
+	Err     error
+}
+
+type watcher struct {
+	opts     WatchOptions
+	notify   *fsnotify.Watcher
+	report   func(WatchEvent)
+	storeDir string
+	files    map[string]bool
+	roots    []string
+	// pending holds when a file is due, last when it last got a version
+	pending map[string]time.Time
+	last    map[string]time.Time
+	due     chan string
+}
+
+// Watch watches paths until ctx is done. report is called from the goroutine
+// running Watch.
+func Watch(ctx context.Context, paths []string, opts WatchOptions, report func(WatchEvent)) error {
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q", pattern)
+		}
+	}
+	storeDir, err := getGodexDir()
+	if err != nil {
+		return err
+	}
+	notify, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start watching: %w", err)
+	}
+	defer notify.Close()
+
+	w := &watcher{
+		opts:     opts,
+		notify:   notify,
+		report:   report,
+		storeDir: storeDir,
+		files:    make(map[string]bool),
+		pending:  make(map[string]time.Time),
+		last:     make(map[string]time.Time),
+		due:      make(chan string),
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if w.inStore(path) {
+			return fmt.Errorf("%s is part of the version store", path)
+		}
+		if info.IsDir() {
+			w.roots = append(w.roots, path)
+			if err := w.addTree(path); err != nil {
+				return err
+			}
+			continue
+		}
+		// editors often save by renaming a new file over the old one, which
+		// only the directory sees
+		w.files[path] = true
+		if err := notify.Add(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-notify.Events:
+			if !ok {
+				return nil
+			}
+			w.handle(ctx, event)
+		case err, ok := <-notify.Errors:
+			if !ok {
+				return nil
+			}
+			report(WatchEvent{Err: err})
+		case path := <-w.due:
+			w.settle(ctx, path)
+		}
+	}
+}
+
+func (w *watcher) inStore(path string) bool {
+	return path == w.storeDir || strings.HasPrefix(path, w.storeDir+string(filepath.Separator))
+}
+
+// addTree watches root and every directory below it that is not excluded.
+func (w *watcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path != root && errors.Is(err, fs.ErrPermission) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != root && (w.inStore(path) || w.excluded(root, path)) {
+			return filepath.SkipDir
+		}
+		if err := w.notify.Add(path); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// rootOf returns the watched directory path is in, or "".
+func (w *watcher) rootOf(path string) string {
+	for _, root := range w.roots {
+		if strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return root
+		}
+	}
+	return ""
+}
+
+func (w *watcher) excluded(root, path string) bool {
+	return matchesGlob(w.opts.Exclude, root, path)
+}
+
+// excludedDir tells whether dir or a directory between it and root is
+// excluded.
+func (w *watcher) excludedDir(root, dir string) bool {
+	for ; dir != root && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if w.excluded(root, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesGlob(patterns []string, root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(name)); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// wanted tells whether path is a file Watch should version.
+func (w *watcher) wanted(path string) bool {
+	if w.files[path] {
+		return true
+	}
+	root := w.rootOf(path)
+	if root == "" || w.inStore(path) {
+		return false
+	}
+	if w.excludedDir(root, path) {
+		return false
+	}
+	return len(w.opts.Include) == 0 || matchesGlob(w.opts.Include, root, path)
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+// ///////////////////////////////////////////////////////////////////////////
+
+func (w *watcher) handle(ctx context.Context, event fsnotify.Event) {
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) && !event.Has(fsnotify.Chmod) {
+		return
+	}
+	path := event.Name
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Lstat(path); err == nil && info.IsDir() {
+			w.watchNewDir(ctx, path)
+			return
+		}
+	}
+	if w.wanted(path) {
+		w.schedule(ctx, path, w.opts.Debounce)
+	}
+}
+
+// watchNewDir starts watching a directory created inside a watched one. Files
+// written into it before the watch was added are picked up by the walk.
+func (w *watcher) watchNewDir(ctx context.Context, dir string) {
+	root := w.rootOf(dir)
+	if root == "" || w.inStore(dir) || w.excludedDir(root, dir) {
+		return
+	}
+	if err := w.addTree(dir); err != nil {
+		w.report(WatchEvent{Path: dir, Err: err})
+		return
+	}
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() && w.wanted(path) {
+			w.schedule(ctx, path, w.opts.Debounce)
+		}
+		return nil
+	})
+}
+
+// schedule makes path due after delay, replacing an earlier deadline. Timers
+// of replaced deadlines still fire and are ignored by settle.
+func (w *watcher) schedule(ctx context.Context, path string, delay time.Duration) {
+	w.pending[path] = time.Now().Add(delay)
+	time.AfterFunc(delay, func() {
+		select {
+		case w.due <- path:
+		case <-ctx.Done():
+		}
+	})
+}
+
+// settle creates a version of path once it is due and the minimum interval
+// since its last version has passed.
+func (w *watcher) settle(ctx context.Context, path string) {
+	deadline, ok := w.pending[path]
+	if !ok || time.Now().Before(deadline) {
+		return
+	}
+	if last, ok := w.last[path]; ok {
+		if wait := w.opts.MinInterval - time.Since(last); wait > 0 {
+			w.schedule(ctx, path, wait)
+			return
+		}
+	}
+	delete(w.pending, path)
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		// removed or replaced again before it settled
+		return
+	}
+	meta, err := CreateAutoVersion(path, w.opts.Message)
+	if errors.Is(err, errVersionExists) {
+		return
+	}
+	if err == nil {
+		w.last[path] = time.Now()
+	}
+	w.report(WatchEvent{Path: path, Version: meta, Err: err})
+}